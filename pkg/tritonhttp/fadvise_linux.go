@@ -0,0 +1,48 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tritonhttp
+
+import (
+	"os"
+	"syscall"
+)
+
+// Advice values of posix_fadvise(2) on Linux
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// adviseSequential tells the OS that f is about to be read once,
+// sequentially, so that it reads ahead more aggressively.
+func adviseSequential(f *os.File) error {
+	return fadvise(f, fadvSequential)
+}
+
+// adviseDontNeed tells the OS that the content of f read so far won't
+// be needed again, so that it doesn't crowd other files out of the page
+// cache.
+func adviseDontNeed(f *os.File) error {
+	return fadvise(f, fadvDontNeed)
+}
+
+// fadvise gives the advice to the OS about the whole of f.
+func fadvise(f *os.File, advice uintptr) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall6(syscall.SYS_FADVISE64, fd, 0, 0, advice, 0, 0)
+	})
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package tritonhttp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAdvise(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "large.bin")
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// The hints are accepted by the OS, and don't change what is read
+	if err := adviseSequential(f); err != nil {
+		t.Fatal(err)
+	}
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := adviseDontNeed(f); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer.Bytes(), content) {
+		t.Fatalf("got: %v bytes, want: %v bytes", buffer.Len(), len(content))
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux || !(amd64 || arm64)
+// +build !linux !amd64,!arm64
+
+package tritonhttp
+
+import "os"
+
+// adviseSequential is a no-op on platforms without posix_fadvise(2).
+func adviseSequential(f *os.File) error {
+	return nil
+}
+
+// adviseDontNeed is a no-op on platforms without posix_fadvise(2).
+func adviseDontNeed(f *os.File) error {
+	return nil
+}
@@ -2,12 +2,56 @@ package tritonhttp
 
 import (
 	"bufio"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
+// defaultMaxHeaderBytes is the default limit on the size of the
+// headers of a request, line ends included.
+const defaultMaxHeaderBytes = 8 << 10
+
+// errRequestHeadersTooLarge is returned by ReadRequest when the
+// headers exceed their size limit.
+var errRequestHeadersTooLarge = errors.New("request headers too large")
+
+// requestLineOverhead is the room left in a request line, beyond the
+// URL, for the method, the version, the spaces and the line end.
+const requestLineOverhead = 32
+
+// errURITooLong is returned by ReadRequest when the URL of the request
+// line exceeds its length limit.
+var errURITooLong = errors.New("request URI too long")
+
+// maxDiscardedBody is the largest request body, in bytes, read and
+// discarded to keep the connection in sync. Requests with larger
+// bodies are rejected instead.
+const maxDiscardedBody = 1 << 20
+
+// http09Proto is the Proto of HTTP/0.9 simple requests, whose request
+// line has no version, e.g. "GET /index.html".
+const http09Proto = "HTTP/0.9"
+
+// http10Proto is the Proto of HTTP/1.0 requests. Their connection is
+// closed after one response, unless the client sends
+// "Connection: keep-alive". Responses to them are still HTTP/1.1, the
+// highest version the server conforms to (RFC 7230, section 2.6).
+const http10Proto = "HTTP/1.0"
+
+// allowedMethods lists the supported methods, as sent in the Allow header.
+const allowedMethods = "GET, HEAD, OPTIONS"
+
+// errMethodNotAllowed is returned by ReadRequest for a well-formed
+// request whose method isn't supported.
+var errMethodNotAllowed = errors.New("method not allowed")
+
+// methodToken matches the syntax of a request method (RFC 7230).
+var methodToken = regexp.MustCompile("^[!#$%&'*+\\-.^_`|~0-9A-Za-z]+$")
+
 type Request struct {
 	Method string // e.g. "GET"
 	URL    string // e.g. "/path/to/a/file"
@@ -21,6 +65,27 @@ type Request struct {
 
 	Host  string // determine from the "Host" header
 	Close bool   // determine from the "Connection" header
+
+	// BodyBytes is the size of the request body, read and discarded.
+	BodyBytes int64
+
+	// Values holds data attached to the request while it is handled,
+	// e.g. by a Tracer for the later stages. It is nil until the first
+	// SetValue.
+	Values map[string]interface{}
+}
+
+// SetValue attaches the value v to req under key.
+func (req *Request) SetValue(key string, v interface{}) {
+	if req.Values == nil {
+		req.Values = make(map[string]interface{})
+	}
+	req.Values[key] = v
+}
+
+// GetValue returns the value attached to req under key, or nil.
+func (req *Request) GetValue(key string) interface{} {
+	return req.Values[key]
 }
 
 // ReadRequest tries to read the next valid request from br.
@@ -32,47 +97,82 @@ type Request struct {
 // and a nil request. In this case, bytesReceived indicates whether or not
 // some bytes are received before the error occurs. This is useful to determine
 // the timeout with partial request received condition.
+//
+// The URL is limited to 8192 bytes, after which it returns errURITooLong,
+// and the headers to 8KB, after which it returns errRequestHeadersTooLarge.
 func ReadRequest(br *bufio.Reader) (req *Request, bytesReceived bool, err error) {
+	return readRequest(br, defaultMaxHeaderBytes, defaultMaxURLLength)
+}
+
+// readRequest is ReadRequest with a limit of maxHeaderBytes on the
+// size of the headers, and of maxURLLength on the length of the URL.
+// They are separate, so that a long URL is told apart from large headers.
+func readRequest(br *bufio.Reader, maxHeaderBytes, maxURLLength int) (req *Request, bytesReceived bool, err error) {
 	req = &Request{}
 
-	// Read start line
-	line, err := ReadLine(br)
+	// Read start line, which is only too long because of its URL
+	lineRemaining := maxURLLength + requestLineOverhead
+	line, err := readLineLimit(br, &lineRemaining)
+	if errors.Is(err, errRequestHeadersTooLarge) {
+		return nil, true, errURITooLong
+	}
 	if err != nil {
-		return nil, false, err
+		return nil, line != "", err
 	}
 
 	method, url, proto, err := parseRequestLine(line)
 	if err != nil {
-		return nil, false, badStringError("malformed start line", line)
+		// A simple request has no headers, and the connection
+		// is closed after the response
+		if method, url, ok := parseSimpleRequestLine(line); ok {
+			if len(url) > maxURLLength {
+				return nil, true, errURITooLong
+			}
+			req.Method = method
+			req.URL = url
+			req.Proto = http09Proto
+			req.Header = map[string]string{}
+			req.Close = true
+			return req, true, nil
+		}
+		return nil, true, badStringError("malformed start line", line)
 	}
 
-	if !validMethod(method) {
-		return nil, false, badStringError("invalid method", method)
+	if !validProto(proto) {
+		return nil, true, badStringError("invalid proto", proto)
 	}
 
-	if !validProto(proto) {
-		return nil, false, badStringError("invalid proto", proto)
+	if len(url) > maxURLLength {
+		return nil, true, errURITooLong
+	}
+
+	// "OPTIONS *" asks about the server as a whole
+	if !validUrl(url) && !(method == "OPTIONS" && url == "*") {
+		return nil, true, badStringError("invalid url", url)
 	}
 
-	if !validUrl(url) {
-		return nil, false, badStringError("invalid url", url)
+	// The method is checked last, so that only an otherwise valid
+	// request line is answered with a 405 rather than a 400
+	if !methodToken.MatchString(method) {
+		return nil, true, badStringError("invalid method", method)
+	}
+	if !validMethod(method) {
+		return nil, true, fmt.Errorf("%w: %q", errMethodNotAllowed, method)
 	}
 
 	req.Method = method
 	req.URL = url
 	req.Proto = proto
+	req.Close = proto == http10Proto
 
 	m := make(map[string]string)
 
+	remaining := maxHeaderBytes
 	for {
-		line, err := ReadLine(br)
+		line, err := readLineLimit(br, &remaining)
 		if err != nil {
-			if line == "" {
-				return nil, false, err
-			}
-
-			req.Close = false
-			return req, false, badStringError("malformed body", line)
+			// The start line is already received, so this is a partial request
+			return nil, true, err
 		}
 		if line == "" {
 			break
@@ -80,12 +180,12 @@ func ReadRequest(br *bufio.Reader) (req *Request, bytesReceived bool, err error)
 
 		key, value, err := getKeyValue(line)
 
-		if (key == "" && value != "") || invalidVal(value) || invalidKey(key) {
+		if (key == "" && value != "") || invalidValue(value) || invalidKey(key) {
 			req.Close = false
-			return req, false, badStringError("malformed body key val", "")
+			return req, true, badStringError("malformed body key val", "")
 		}
 		if err != nil {
-			return nil, false, err
+			return nil, true, err
 		}
 		key = CanonicalHeaderKey(key)
 		if key == "Host" {
@@ -93,6 +193,8 @@ func ReadRequest(br *bufio.Reader) (req *Request, bytesReceived bool, err error)
 		} else if strings.EqualFold(key, "Connection") {
 			if value == "close" {
 				req.Close = true
+			} else if proto == http10Proto && strings.EqualFold(value, "keep-alive") {
+				req.Close = false
 			} else {
 				continue
 			}
@@ -103,9 +205,135 @@ func ReadRequest(br *bufio.Reader) (req *Request, bytesReceived bool, err error)
 	}
 
 	req.Header = m
+
+	// The server doesn't use request bodies, but a body must still be
+	// consumed so that it isn't parsed as the next pipelined request
+	if _, ok := m["Transfer-Encoding"]; ok {
+		return nil, true, badStringError("unsupported transfer encoding", m["Transfer-Encoding"])
+	}
+	if v, ok := m["Content-Length"]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return nil, true, badStringError("invalid content length", v)
+		}
+		if n > maxDiscardedBody {
+			return nil, true, badStringError("request body too large", v)
+		}
+		if req.BodyBytes, err = io.CopyN(io.Discard, br, n); err != nil {
+			return nil, true, err
+		}
+	}
 	return req, true, nil
 }
 
+// readLineLimit is like ReadLine, but reads at most *remaining bytes,
+// which it decreases by the size of the line read, line end included.
+// It returns errRequestHeadersTooLarge if the line is longer, without
+// reading the rest of it.
+func readLineLimit(br *bufio.Reader, remaining *int) (string, error) {
+	var line []byte
+	for {
+		s, err := br.ReadSlice('\n')
+		line = append(line, s...)
+		if len(line) > *remaining {
+			return string(line), errRequestHeadersTooLarge
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if err != nil {
+			return string(line), err
+		}
+		// Return the line when reaching line end
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			*remaining -= len(line)
+			return string(line[:len(line)-2]), nil
+		}
+	}
+}
+
+// HTTPRange is a byte range of a file, as requested by a Range header.
+type HTTPRange struct {
+	Start  int64 // offset of the first byte
+	Length int64 // number of bytes
+}
+
+// errRangeNotSatisfiable is returned by ParseRange when none of the
+// ranges overlap the file.
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ParseRange parses the value of a Range header, e.g. "bytes=0-99,-50",
+// into the ranges it requests of a file of the given size (RFC 7233).
+// Ranges past the end of the file are dropped, and the error is
+// errRangeNotSatisfiable if no range is left.
+// An empty header means the whole file, and results in no ranges.
+func ParseRange(header string, size int64) ([]HTTPRange, error) {
+	if header == "" {
+		return nil, nil
+	}
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, badStringError("invalid range", header)
+	}
+
+	var ranges []HTTPRange
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, badStringError("invalid range", header)
+		}
+		first, last := strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+
+		if first == "" {
+			// A suffix range, e.g. "-50" for the last 50 bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, badStringError("invalid range", header)
+			}
+			if n > size {
+				n = size
+			}
+			if n == 0 {
+				continue
+			}
+			ranges = append(ranges, HTTPRange{Start: size - n, Length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, badStringError("invalid range", header)
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil, badStringError("invalid range", header)
+			}
+			if end >= size {
+				end = size - 1
+			}
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, HTTPRange{Start: start, Length: end - start + 1})
+	}
+	if len(ranges) == 0 {
+		return nil, errRangeNotSatisfiable
+	}
+	return ranges, nil
+}
+
+// Referer returns the value of the "Referer" header of req,
+// or "" if the client did not send one.
+func (req *Request) Referer() string {
+	return req.Header["Referer"]
+}
+
 func badStringError(what, val string) error {
 	return errors.New(fmt.Sprintf("%s %q", what, val))
 }
@@ -114,20 +342,32 @@ func invalidValue(val string) bool {
 	if strings.Contains(val, "\r\n") || (val != "" && string(val[0]) == string(" ")) {
 		return true
 	}
+	// Control characters, e.g. NUL, are never valid in a header value,
+	// but horizontal tabs are
+	for i := 0; i < len(val); i++ {
+		if (val[i] < ' ' && val[i] != '\t') || val[i] == 0x7f {
+			return true
+		}
+	}
 
 	return false
 }
 
 func validMethod(method string) bool {
-	return method == "GET"
+	return method == "GET" || method == "HEAD" || method == "OPTIONS"
 }
 
 func validProto(proto string) bool {
-	return proto == "HTTP/1.1"
+	return proto == "HTTP/1.1" || proto == http10Proto
 }
 
 func validUrl(url string) bool {
-	return string(url[0]) == string("/")
+	// Backslashes are rejected on every OS, since some platforms
+	// would treat them as path separators.
+	if strings.Contains(url, "\\") {
+		return false
+	}
+	return url != "" && string(url[0]) == string("/")
 }
 
 func invalidKey(key string) bool {
@@ -143,6 +383,16 @@ func parseRequestLine(line string) (string, string, string, error) {
 	return fields[0], fields[1], fields[2], nil
 }
 
+// parseSimpleRequestLine parses the request line of an HTTP/0.9 simple
+// request, which is only supported for GET.
+func parseSimpleRequestLine(line string) (method string, url string, ok bool) {
+	fields := strings.Split(line, " ")
+	if len(fields) != 2 || fields[0] != "GET" || !validUrl(fields[1]) {
+		return "", "", false
+	}
+	return fields[0], fields[1], true
+}
+
 func getKeyValue(line string) (string, string, error) {
 	fields := strings.SplitN(line, ":", 2)
 	if len(fields) != 2 {
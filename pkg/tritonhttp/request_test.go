@@ -2,6 +2,7 @@ package tritonhttp
 
 import (
 	"bufio"
+	"errors"
 	"reflect"
 	"strings"
 	"testing"
@@ -77,6 +78,139 @@ func TestReadGoodRequest(t *testing.T) {
 				Close: true,
 			},
 		},
+		{
+			"ColonsInHeaderValue",
+			"GET /index.html HTTP/1.1\r\n" +
+				"Host: test:8080\r\n" +
+				"Referer: http://host:8080/path\r\n" +
+				"X-Time: 12:00:00\r\n" +
+				"\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{
+					"Referer": "http://host:8080/path",
+					"X-Time":  "12:00:00",
+				},
+				Host:  "test:8080",
+				Close: false,
+			},
+		},
+		{
+			"TabInHeaderValue",
+			"GET /index.html HTTP/1.1\r\n" +
+				"Host: test\r\n" +
+				"Key1: val\t1\r\n" +
+				"\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{
+					"Key1": "val\t1",
+				},
+				Host:  "test",
+				Close: false,
+			},
+		},
+		{
+			"Head",
+			"HEAD /index.html HTTP/1.1\r\n" +
+				"Host: test\r\n" +
+				"\r\n",
+			&Request{
+				Method: "HEAD",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  false,
+			},
+		},
+		{
+			"Options",
+			"OPTIONS / HTTP/1.1\r\n" +
+				"Host: test\r\n" +
+				"\r\n",
+			&Request{
+				Method: "OPTIONS",
+				URL:    "/",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  false,
+			},
+		},
+		{
+			"OptionsAsterisk",
+			"OPTIONS * HTTP/1.1\r\n" +
+				"Host: test\r\n" +
+				"\r\n",
+			&Request{
+				Method: "OPTIONS",
+				URL:    "*",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  false,
+			},
+		},
+		{
+			"HTTP10",
+			"GET /index.html HTTP/1.0\r\n" +
+				"Host: test\r\n" +
+				"\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.0",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  true,
+			},
+		},
+		{
+			"HTTP10KeepAlive",
+			"GET /index.html HTTP/1.0\r\n" +
+				"Host: test\r\n" +
+				"Connection: keep-alive\r\n" +
+				"\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.0",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  false,
+			},
+		},
+		{
+			"HTTP10Close",
+			"GET /index.html HTTP/1.0\r\n" +
+				"Host: test\r\n" +
+				"Connection: close\r\n" +
+				"\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.0",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  true,
+			},
+		},
+		{
+			"SimpleRequest",
+			"GET /index.html\r\n",
+			&Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/0.9",
+				Header: map[string]string{},
+				Close:  true,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -87,6 +221,38 @@ func TestReadGoodRequest(t *testing.T) {
 	}
 }
 
+func TestRequestReferer(t *testing.T) {
+	reqText := "GET /index.html HTTP/1.1\r\n" +
+		"Host: test\r\n" +
+		"referer: http://example.com/from.html\r\n" +
+		"\r\n"
+	req, _, err := ReadRequest(bufio.NewReader(strings.NewReader(reqText)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := req.Referer(), "http://example.com/from.html"; got != want {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	if v, ok := req.Header["Referer"]; !ok || v != "http://example.com/from.html" {
+		t.Fatalf("missing canonical Referer header, got: %v", req.Header)
+	}
+}
+
+func TestRequestValues(t *testing.T) {
+	req := &Request{}
+	if v := req.GetValue("user"); v != nil {
+		t.Fatalf("got: %v, want: nil", v)
+	}
+	req.SetValue("user", "alice")
+	req.SetValue("admin", true)
+	if v := req.GetValue("user"); v != "alice" {
+		t.Fatalf("got: %v, want: %v", v, "alice")
+	}
+	if v := req.GetValue("admin"); v != true {
+		t.Fatalf("got: %v, want: %v", v, true)
+	}
+}
+
 func TestReadBadRequest(t *testing.T) {
 	var tests = []struct {
 		name string
@@ -100,12 +266,80 @@ func TestReadBadRequest(t *testing.T) {
 			"Empty",
 			"\r\n",
 		},
+		{
+			"EmptyURL",
+			"GET \r\nHost: test\r\n\r\n",
+		},
+		{
+			"MissingURL",
+			"GET  HTTP/1.1\r\n\r\n",
+		},
+		{
+			"OneField",
+			"GET\r\nHost: test\r\n\r\n",
+		},
+		{
+			"SimpleRequestBadMethod",
+			"HEAD /index.html\r\n",
+		},
+		{
+			"NULInHeaderValue",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nKey: val\x00/../../etc/passwd\r\n\r\n",
+		},
+		{
+			"ControlCharInHeaderValue",
+			"GET /index.html HTTP/1.1\r\nHost: te\x1bst\r\n\r\n",
+		},
+		{
+			"InvalidContentLength",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: abc\r\n\r\n",
+		},
+		{
+			"NegativeContentLength",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: -1\r\n\r\n",
+		},
+		{
+			"TruncatedBody",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: 10\r\n\r\nhello",
+		},
+		{
+			"TransferEncoding",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+		},
+		{
+			"Backslash",
+			"GET /..\\..\\secret.txt HTTP/1.1\r\nHost: test\r\n\r\n",
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			reqGot, _, err := ReadRequest(bufio.NewReader(strings.NewReader(tt.req)))
 			checkBadRequest(t, err, reqGot)
+			if errors.Is(err, errMethodNotAllowed) {
+				t.Fatalf("got: %v, want: a bad request error", err)
+			}
+		})
+	}
+}
+
+func TestReadMethodNotAllowed(t *testing.T) {
+	var tests = []struct {
+		name string
+		req  string
+	}{
+		{"Post", "POST /index.html HTTP/1.1\r\nHost: test\r\n\r\n"},
+		{"Put", "PUT /index.html HTTP/1.1\r\nHost: test\r\n\r\n"},
+		{"Delete", "DELETE /index.html HTTP/1.1\r\nHost: test\r\n\r\n"},
+		{"Lowercase", "get /index.html HTTP/1.1\r\nHost: test\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqGot, _, err := ReadRequest(bufio.NewReader(strings.NewReader(tt.req)))
+			if !errors.Is(err, errMethodNotAllowed) {
+				t.Fatalf("got: %v, %v, want: %v", reqGot, err, errMethodNotAllowed)
+			}
 		})
 	}
 }
@@ -139,6 +373,33 @@ func TestReadMultipleRequests(t *testing.T) {
 				},
 			},
 		},
+		{
+			"BodyGood",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: 25\r\n\r\n" +
+				"GET /body.html HTTP/1.1\r\n" +
+				"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n",
+			[]*Request{
+				{
+					Method: "GET",
+					URL:    "/index.html",
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{
+						"Content-Length": "25",
+					},
+					Host:      "test",
+					Close:     false,
+					BodyBytes: 25,
+				},
+				{
+					Method: "GET",
+					URL:    "/index.html",
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{},
+					Host:   "test",
+					Close:  false,
+				},
+			},
+		},
 		{
 			"GoodBad",
 			"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
@@ -171,3 +432,218 @@ func TestReadMultipleRequests(t *testing.T) {
 		})
 	}
 }
+
+func TestReadPartialRequest(t *testing.T) {
+	var tests = []struct {
+		name              string
+		reqText           string
+		bytesReceivedWant bool
+	}{
+		{
+			"NoBytes",
+			"",
+			false,
+		},
+		{
+			"PartialStartLine",
+			"GET /index.ht",
+			true,
+		},
+		{
+			"PartialHeaders",
+			"GET /index.html HTTP/1.1\r\nHost: te",
+			true,
+		},
+		{
+			"MissingHeaderEnd",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\n",
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqGot, bytesReceived, err := ReadRequest(bufio.NewReader(strings.NewReader(tt.reqText)))
+			checkBadRequest(t, err, reqGot)
+			if bytesReceived != tt.bytesReceivedWant {
+				t.Fatalf("bytesReceived got: %v, want: %v", bytesReceived, tt.bytesReceivedWant)
+			}
+		})
+	}
+}
+
+func TestReadRequestHeadersTooLarge(t *testing.T) {
+	var tests = []struct {
+		name           string
+		reqText        string
+		maxHeaderBytes int
+		maxURLLength   int
+		errWant        error
+	}{
+		{
+			"ManyHeaders",
+			"GET /index.html HTTP/1.1\r\n" + strings.Repeat("A: b\r\n", 10000) + "\r\n",
+			defaultMaxHeaderBytes,
+			defaultMaxURLLength,
+			errRequestHeadersTooLarge,
+		},
+		{
+			"LongLine",
+			"GET /index.html HTTP/1.1\r\nKey: " + strings.Repeat("x", 10000) + "\r\n\r\n",
+			defaultMaxHeaderBytes,
+			defaultMaxURLLength,
+			errRequestHeadersTooLarge,
+		},
+		{
+			"LongRequestLine",
+			"GET /" + strings.Repeat("x", 10000) + " HTTP/1.1\r\n\r\n",
+			defaultMaxHeaderBytes,
+			defaultMaxURLLength,
+			errURITooLong,
+		},
+		{
+			// The URL alone fits in the header budget, but not its own
+			"LongURL",
+			"GET /" + strings.Repeat("x", 100) + " HTTP/1.1\r\n\r\n",
+			defaultMaxHeaderBytes,
+			100,
+			errURITooLong,
+		},
+		{
+			"URLAtLimit",
+			"GET /" + strings.Repeat("x", 99) + " HTTP/1.1\r\n\r\n",
+			14,
+			100,
+			nil,
+		},
+		{
+			"AtLimit",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n", // 12 + 2 bytes of headers
+			14,
+			defaultMaxURLLength,
+			nil,
+		},
+		{
+			"OverLimit",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n",
+			13,
+			defaultMaxURLLength,
+			errRequestHeadersTooLarge,
+		},
+		{
+			"FewHeaders",
+			"GET /index.html HTTP/1.1\r\n" +
+				"Host: test\r\n" +
+				"User-Agent: curl/7.79.1\r\n" +
+				"Accept: */*\r\n" +
+				"Accept-Encoding: gzip\r\n" +
+				"\r\n",
+			defaultMaxHeaderBytes,
+			defaultMaxURLLength,
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := readRequest(bufio.NewReader(strings.NewReader(tt.reqText)), tt.maxHeaderBytes, tt.maxURLLength)
+			if tt.errWant == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.errWant) {
+				t.Fatalf("got: %v, want: %v", err, tt.errWant)
+			}
+		})
+	}
+}
+
+func TestReadRequestDefaultLimits(t *testing.T) {
+	var tests = []struct {
+		name    string
+		urlLen  int
+		errWant error
+	}{
+		{"Longest", defaultMaxURLLength, nil},
+		{"TooLong", defaultMaxURLLength + 1, errURITooLong},
+		{"WayTooLong", 8300, errURITooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reqText := "GET /" + strings.Repeat("x", tt.urlLen-1) + " HTTP/1.1\r\nHost: test\r\n\r\n"
+			_, _, err := ReadRequest(bufio.NewReader(strings.NewReader(reqText)))
+			if err != tt.errWant {
+				t.Fatalf("got: %v, want: %v", err, tt.errWant)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	var tests = []struct {
+		name   string
+		header string
+		size   int64
+		want   []HTTPRange
+	}{
+		{"Empty", "", 100, nil},
+		{"Single", "bytes=0-9", 100, []HTTPRange{{0, 10}}},
+		{"OneByte", "bytes=5-5", 100, []HTTPRange{{5, 1}}},
+		{"OpenEnded", "bytes=90-", 100, []HTTPRange{{90, 10}}},
+		{"Suffix", "bytes=-10", 100, []HTTPRange{{90, 10}}},
+		{"SuffixLargerThanFile", "bytes=-200", 100, []HTTPRange{{0, 100}}},
+		{"EndPastFile", "bytes=50-1000", 100, []HTTPRange{{50, 50}}},
+		{"Multiple", "bytes=0-9,20-29,-5", 100, []HTTPRange{{0, 10}, {20, 10}, {95, 5}}},
+		{"Spaces", "bytes= 0-9 , 20-29", 100, []HTTPRange{{0, 10}, {20, 10}}},
+		{"DropsUnsatisfiable", "bytes=0-9,200-299", 100, []HTTPRange{{0, 10}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRange(tt.header, tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseBadRange(t *testing.T) {
+	var tests = []struct {
+		name           string
+		header         string
+		size           int64
+		notSatisfiable bool
+	}{
+		{"WrongUnit", "items=0-9", 100, false},
+		{"NoPrefix", "0-9", 100, false},
+		{"NoDash", "bytes=10", 100, false},
+		{"NoBounds", "bytes=-", 100, false},
+		{"NotANumber", "bytes=a-9", 100, false},
+		{"Reversed", "bytes=9-0", 100, false},
+		{"NegativeSuffix", "bytes=--5", 100, false},
+		{"OneBadSpec", "bytes=0-9,x-y", 100, false},
+		{"StartPastFile", "bytes=100-", 100, true},
+		{"ZeroSuffix", "bytes=-0", 100, true},
+		{"EmptyFile", "bytes=0-", 0, true},
+		{"NoRanges", "bytes=", 100, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseRange(tt.header, tt.size)
+			if err == nil {
+				t.Fatalf("got: %v, want: error", got)
+			}
+			if (err == errRangeNotSatisfiable) != tt.notSatisfiable {
+				t.Fatalf("not satisfiable got: %v, want: %v (%v)", err == errRangeNotSatisfiable, tt.notSatisfiable, err)
+			}
+		})
+	}
+}
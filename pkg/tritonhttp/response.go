@@ -2,16 +2,42 @@ package tritonhttp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sort"
+	"sync"
 )
 
+const (
+	// Default limits on the headers of a response
+	defaultMaxResponseHeaders     = 100
+	defaultMaxResponseHeaderBytes = 64 << 10
+)
+
+var errResponseHeadersTooLarge = errors.New("response headers too large")
+
+// copyBufferPool holds the buffers used by WriteBody, as *[]byte.
+var copyBufferPool sync.Pool
+
 var statusText = map[int]string{
-	statusOK:               "OK",
-	statusMethodNotAllowed: "Bad Request",
-	statusMethodNotFound:   "Not Found",
+	statusOK:                  "OK",
+	statusNoContent:           "No Content",
+	statusPartialContent:      "Partial Content",
+	statusMovedPermanently:    "Moved Permanently",
+	statusFound:               "Found",
+	statusNotModified:         "Not Modified",
+	statusBadRequest:          "Bad Request",
+	statusForbidden:           "Forbidden",
+	statusMethodNotFound:      "Not Found",
+	statusMethodNotAllowed:    "Method Not Allowed",
+	statusRequestTimeout:      "Request Timeout",
+	statusURITooLong:          "URI Too Long",
+	statusRangeNotSatisfiable: "Range Not Satisfiable",
+	statusHeaderTooLarge:      "Request Header Fields Too Large",
+	statusInternalError:       "Internal Server Error",
+	statusUnavailable:         "Service Unavailable",
 }
 
 type Response struct {
@@ -30,10 +56,66 @@ type Response struct {
 	// FilePath is the local path to the file to serve.
 	// It could be "", which means there is no file to serve.
 	FilePath string
+
+	// Body is an in-memory body to write when there is no file to serve,
+	// e.g. a generated page. FilePath takes precedence if both are set.
+	// The handler that sets it is responsible for Content-Length.
+	Body []byte
+
+	// bodyRange, if set, is the range of the file or Body to write
+	// as the body, for a 206 Partial Content response.
+	bodyRange *HTTPRange
+
+	// copyBufferSize, if not zero, is the size of the buffer used to
+	// copy the file to the writer. Otherwise io.Copy picks the buffer,
+	// or doesn't use one, e.g. with sendfile to a TCP connection.
+	copyBufferSize int
+
+	// largeFileHint, if not zero, is the size in bytes above which the
+	// file is read with hints to the OS that it's read once, sequentially.
+	largeFileHint int64
+
+	// bodyBytes is the number of body bytes written by WriteBody.
+	bodyBytes int64
+
+	// inFlightBytes is the size of Body accounted for by the server,
+	// see Server.MaxInFlightBodyBytes.
+	inFlightBytes int64
+
+	// maxHeaders and maxHeaderBytes limit the number of headers and
+	// their total size in bytes. Zero means the default limit.
+	maxHeaders     int
+	maxHeaderBytes int
+}
+
+// Reset clears res so that it can be reused for another response.
+// The header map is kept, emptied, to save an allocation.
+func (res *Response) Reset() {
+	header := res.Header
+	for k := range header {
+		delete(header, k)
+	}
+	*res = Response{Header: header}
+}
+
+// newHeader returns an empty header map for res, reusing the
+// existing res.Header if there is one.
+func (res *Response) newHeader() map[string]string {
+	if res.Header == nil {
+		return make(map[string]string)
+	}
+	for k := range res.Header {
+		delete(res.Header, k)
+	}
+	return res.Header
 }
 
 // Write writes the res to the w.
 func (res *Response) Write(w io.Writer) error {
+	// Check the headers first, so that nothing is written if they are invalid
+	if err := res.checkHeaders(); err != nil {
+		return err
+	}
 	if err := res.WriteStatusLine(w); err != nil {
 		return err
 	}
@@ -67,6 +149,10 @@ func (res *Response) WriteStatusLine(w io.Writer) error {
 // For HTTP, there is no need to write headers in any particular order.
 // TritonHTTP requires to write in sorted order for the ease of testing.
 func (res *Response) WriteSortedHeaders(w io.Writer) error {
+	if err := res.checkHeaders(); err != nil {
+		return err
+	}
+
 	response := ""
 	delimiter := "\r\n"
 	responseMap := make(map[string]string)
@@ -78,8 +164,7 @@ func (res *Response) WriteSortedHeaders(w io.Writer) error {
 	sort.Strings(keys)
 
 	for _, k := range keys {
-		v := m[k]
-		fmt.Println(k, v)
+		v := responseMap[k]
 		line := k + ": " + v
 		response = response + line + delimiter
 	}
@@ -96,66 +181,84 @@ func (res *Response) WriteSortedHeaders(w io.Writer) error {
 	return nil
 }
 
+// checkHeaders returns an error if the headers of res exceed
+// the limits on their number or total size.
+func (res *Response) checkHeaders() error {
+	maxHeaders := res.maxHeaders
+	if maxHeaders == 0 {
+		maxHeaders = defaultMaxResponseHeaders
+	}
+	maxHeaderBytes := res.maxHeaderBytes
+	if maxHeaderBytes == 0 {
+		maxHeaderBytes = defaultMaxResponseHeaderBytes
+	}
+
+	if len(res.Header) > maxHeaders {
+		return fmt.Errorf("%w: %v headers, limit is %v", errResponseHeadersTooLarge, len(res.Header), maxHeaders)
+	}
+	size := 0
+	for k, v := range res.Header {
+		size += len(k) + len(": ") + len(v) + len("\r\n")
+	}
+	if size > maxHeaderBytes {
+		return fmt.Errorf("%w: %v bytes, limit is %v", errResponseHeadersTooLarge, size, maxHeaderBytes)
+	}
+	return nil
+}
+
 // WriteBody writes res' file content as the response body to w.
-// It doesn't write anything if there is no file to serve.
+// If there is no file to serve, it writes res.Body instead, if any.
+// Nothing is written in response to a HEAD request.
 func (res *Response) WriteBody(w io.Writer) error {
-	if res.FilePath == "" {
-		//Nothing to write, returning
+	if res.Request != nil && res.Request.Method == "HEAD" {
 		return nil
 	}
-
-	bw := bufio.NewWriter(w)
-
-	var BufferSize int64 = 100
-	file, err := os.Open(res.FilePath)
-	if err != nil {
-		fmt.Println(err)
+	r := res.bodyRange
+	if res.FilePath == "" {
+		body := res.Body
+		if r != nil {
+			body = body[r.Start : r.Start+r.Length]
+		}
+		if len(body) == 0 {
+			//Nothing to write, returning
+			return nil
+		}
+		n, err := w.Write(body)
+		res.bodyBytes = int64(n)
 		return err
 	}
-	fi, err := file.Stat()
+
+	file, err := os.Open(res.FilePath)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-
-	filesize := fi.Size()
 	defer file.Close()
-
-	buffer := make([]byte, BufferSize)
-
-	var i int64 = 0
-
-	for i = 0; i < filesize/BufferSize; i++ {
-		_, err := file.Read(buffer)
-
-		if err != nil {
-			if err != io.EOF {
-				fmt.Println(err)
-			}
-			break
+	if res.largeFileHint > 0 {
+		if info, err := file.Stat(); err == nil && info.Size() > res.largeFileHint {
+			// The hints are best effort, the file is served either way
+			_ = adviseSequential(file)
+			defer func() { _ = adviseDontNeed(file) }()
 		}
+	}
 
-		if _, err := bw.Write(buffer); err != nil {
-			return err
-		}
-		if err := bw.Flush(); err != nil {
+	var src io.Reader = file
+	if r != nil {
+		if _, err := file.Seek(r.Start, io.SeekStart); err != nil {
 			return err
 		}
+		src = io.LimitReader(file, r.Length)
 	}
-	buffer = make([]byte, filesize%BufferSize)
-	_, err = file.Read(buffer)
-	if err != nil {
-		if err != io.EOF {
-			fmt.Println(err)
-		}
-	}
-	if _, err := bw.Write(buffer); err != nil {
+	if res.copyBufferSize == 0 {
+		res.bodyBytes, err = io.Copy(w, src)
 		return err
 	}
-	if err := bw.Flush(); err != nil {
-		return err
+	bufp, _ := copyBufferPool.Get().(*[]byte)
+	if bufp == nil || len(*bufp) != res.copyBufferSize {
+		buf := make([]byte, res.copyBufferSize)
+		bufp = &buf
 	}
-
-	bw.Flush()
-	return nil
+	defer copyBufferPool.Put(bufp)
+	// Hide ReaderFrom and WriterTo, which would bypass the buffer
+	res.bodyBytes, err = io.CopyBuffer(struct{ io.Writer }{w}, struct{ io.Reader }{src}, *bufp)
+	return err
 }
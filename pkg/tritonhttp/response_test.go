@@ -2,7 +2,13 @@ package tritonhttp
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -56,6 +62,29 @@ func TestWriteSortedHeaders(t *testing.T) {
 				"Misc: hello world\r\n" +
 				"\r\n",
 		},
+		{
+			"Several",
+			&Response{
+				Header: map[string]string{
+					"Last-Modified":  "Sun, 06 Nov 1994 08:49:37 GMT",
+					"Content-Type":   "text/html; charset=utf-8",
+					"Date":           "foobar",
+					"Content-Length": "12",
+					"Connection":     "close",
+				},
+			},
+			"Connection: close\r\n" +
+				"Content-Length: 12\r\n" +
+				"Content-Type: text/html; charset=utf-8\r\n" +
+				"Date: foobar\r\n" +
+				"Last-Modified: Sun, 06 Nov 1994 08:49:37 GMT\r\n" +
+				"\r\n",
+		},
+		{
+			"Empty",
+			&Response{},
+			"\r\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -72,25 +101,125 @@ func TestWriteSortedHeaders(t *testing.T) {
 	}
 }
 
+func TestWriteHeadersTooLarge(t *testing.T) {
+	manyHeaders := make(map[string]string)
+	for i := 0; i < 101; i++ {
+		manyHeaders[fmt.Sprintf("X-Header-%d", i)] = "v"
+	}
+	var tests = []struct {
+		name    string
+		res     *Response
+		wantErr bool
+	}{
+		{
+			"TooMany",
+			&Response{Proto: "HTTP/1.1", StatusCode: 200, Header: manyHeaders},
+			true,
+		},
+		{
+			"TooManyConfigured",
+			&Response{Proto: "HTTP/1.1", StatusCode: 200, Header: map[string]string{
+				"Date": "foobar",
+				"Misc": "hello world",
+			}, maxHeaders: 1},
+			true,
+		},
+		{
+			"TooBig",
+			&Response{Proto: "HTTP/1.1", StatusCode: 200, Header: map[string]string{
+				"Misc": strings.Repeat("x", 64<<10),
+			}},
+			true,
+		},
+		{
+			"TooBigConfigured",
+			&Response{Proto: "HTTP/1.1", StatusCode: 200, Header: map[string]string{
+				"Misc": "hello world", // 19 bytes with ": " and "\r\n"
+			}, maxHeaderBytes: 18},
+			true,
+		},
+		{
+			"WithinLimits",
+			&Response{Proto: "HTTP/1.1", StatusCode: 200, Header: map[string]string{
+				"Misc": "hello world",
+			}, maxHeaders: 1, maxHeaderBytes: 19},
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			err := tt.res.Write(&buffer)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if !errors.Is(err, errResponseHeadersTooLarge) {
+				t.Fatalf("got: %v, want: %v", err, errResponseHeadersTooLarge)
+			}
+			if buffer.Len() != 0 {
+				t.Fatalf("got unexpected bytes written: %q", buffer.String())
+			}
+		})
+	}
+}
+
 func TestWriteBody(t *testing.T) {
+	// A file whose size is not a multiple of any read buffer size
+	random := make([]byte, 257)
+	rand.New(rand.NewSource(1)).Read(random)
+	randomPath := filepath.Join(t.TempDir(), "random.bin")
+	if err := os.WriteFile(randomPath, random, 0644); err != nil {
+		t.Fatal(err)
+	}
+
 	var tests = []struct {
-		name string
-		path string
+		name           string
+		path           string
+		copyBufferSize int
+		largeFileHint  int64
 	}{
 		{
 			"Basic",
 			"testdata/index.html",
+			0,
+			0,
+		},
+		{
+			"Random",
+			randomPath,
+			0,
+			0,
+		},
+		{
+			"RandomSmallBuffer",
+			randomPath,
+			100,
+			0,
+		},
+		{
+			"RandomLargeFileHint",
+			randomPath,
+			0,
+			256, // The file is 257 bytes
 		},
 		{
 			"NoBody",
 			"", // An empty path means there is no body to write
+			0,
+			0,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			res := &Response{
-				FilePath: tt.path,
+				FilePath:       tt.path,
+				copyBufferSize: tt.copyBufferSize,
+				largeFileHint:  tt.largeFileHint,
 			}
 			var buffer bytes.Buffer
 			if err := res.WriteBody(&buffer); err != nil {
@@ -123,3 +252,176 @@ func TestWriteBody(t *testing.T) {
 		})
 	}
 }
+
+func TestWriteBodySource(t *testing.T) {
+	file, err := os.ReadFile("testdata/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte("<h1>generated</h1>\n")
+
+	var tests = []struct {
+		name     string
+		res      *Response
+		bodyWant []byte
+	}{
+		{"BodyOnly", &Response{Body: body}, body},
+		{"FilePathOnly", &Response{FilePath: "testdata/index.html"}, file},
+		{"FilePathFirst", &Response{FilePath: "testdata/index.html", Body: body}, file},
+		{"HeadBody", &Response{Body: body, Request: &Request{Method: "HEAD"}}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := tt.res.WriteBody(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buffer.Bytes(), tt.bodyWant) {
+				t.Fatalf("got: %q, want: %q", buffer.Bytes(), tt.bodyWant)
+			}
+		})
+	}
+}
+
+func TestResponseReset(t *testing.T) {
+	s := &Server{
+		Addr:           ":0",
+		DocRoot:        "testdata",
+		EmitContentMD5: true,
+	}
+	res := &Response{}
+	s.handleGoodRequest(&Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+		Close:  true,
+	}, res)
+	if res.StatusCode != 200 || res.FilePath == "" || len(res.Header) == 0 {
+		t.Fatalf("unexpected response: %+v", res)
+	}
+
+	res.Reset()
+	if res.StatusCode != 0 || res.Proto != "" || res.FilePath != "" || res.Body != nil ||
+		res.Request != nil || len(res.Header) != 0 {
+		t.Fatalf("response not reset: %+v", res)
+	}
+
+	// Nothing from the first response leaks into the next one
+	s.handleGoodRequest(&Request{
+		Method: "GET",
+		URL:    "/notexist.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	}, res)
+	var buffer bytes.Buffer
+	if err := res.Write(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	got := buffer.String()
+	if !strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\nContent-Length: 49\r\n") ||
+		!strings.HasSuffix(got, "GMT\r\n\r\n"+string(notFoundBody)) || strings.Count(got, "\r\n") != 5 {
+		t.Fatalf("unexpected response: %q", got)
+	}
+}
+
+func benchmarkRequest() *Request {
+	return &Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	}
+}
+
+func BenchmarkHandleGoodRequest(b *testing.B) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res := s.HandleGoodRequest(benchmarkRequest())
+		if err := res.Write(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHandleGoodRequestPooled(b *testing.B) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res := responsePool.Get().(*Response)
+		s.handleGoodRequest(benchmarkRequest(), res)
+		if err := res.Write(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+		res.Reset()
+		responsePool.Put(res)
+	}
+}
+
+func BenchmarkWriteBody(b *testing.B) {
+	path := filepath.Join(b.TempDir(), "large.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 10<<20), 0644); err != nil {
+		b.Fatal(err)
+	}
+	for _, size := range []int{100, 32 << 10} {
+		b.Run(fmt.Sprintf("Buffer=%v", size), func(b *testing.B) {
+			res := &Response{
+				FilePath:       path,
+				copyBufferSize: size,
+			}
+			b.SetBytes(10 << 20)
+			for i := 0; i < b.N; i++ {
+				// A bare io.Writer, so that the buffer is used for every write
+				if err := res.WriteBody(struct{ io.Writer }{io.Discard}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// failingWriter fails every write after the first n bytes.
+type failingWriter struct {
+	n      int
+	failed int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.failed > 0 || len(b) > w.n {
+		w.failed++
+		written := w.n
+		w.n = 0
+		return written, errors.New("connection closed")
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
+func TestWriteBodyAbort(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "large.bin")
+	if err := os.WriteFile(path, bytes.Repeat([]byte("x"), 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	res := &Response{
+		FilePath: path,
+	}
+	w := &failingWriter{n: 1000}
+	if err := res.WriteBody(w); err == nil {
+		t.Fatalf("got: nil, want: error")
+	}
+	// The copy stops at the first failed write, instead of going through the file
+	if w.failed != 1 {
+		t.Fatalf("failed writes got: %v, want: %v", w.failed, 1)
+	}
+}
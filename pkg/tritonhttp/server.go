@@ -2,24 +2,89 @@ package tritonhttp
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"io"
 	"log"
 	"net"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	responseProto = "HTTP/1.1"
 
-	statusOK               = 200
-	statusMethodNotAllowed = 400
-	statusMethodNotFound   = 404
+	statusOK                  = 200
+	statusNoContent           = 204
+	statusPartialContent      = 206
+	statusMovedPermanently    = 301
+	statusFound               = 302
+	statusNotModified         = 304
+	statusBadRequest          = 400
+	statusForbidden           = 403
+	statusMethodNotFound      = 404
+	statusMethodNotAllowed    = 405
+	statusRequestTimeout      = 408
+	statusURITooLong          = 414
+	statusRangeNotSatisfiable = 416
+	statusHeaderTooLarge      = 431
+	statusInternalError       = 500
+	statusUnavailable         = 503
+
+	// maintenanceRetryAfter is the Retry-After value, in seconds,
+	// sent with maintenance mode responses.
+	maintenanceRetryAfter = "120"
+
+	defaultManifestPath = "/manifest.json"
+	defaultManifestTTL  = time.Minute
+
+	defaultReadTimeout = 5 * time.Second
+
+	// minAcceptDelay and maxAcceptDelay bound the wait after a failed
+	// Accept, as in net/http.
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = time.Second
+
+	// faviconCacheControl is the Cache-Control of DefaultFavicon,
+	// which doesn't change while the server runs.
+	faviconCacheControl = "public, max-age=604800"
+
+	// immutableCacheControl is the Cache-Control of the files matching
+	// ImmutablePattern, which never change under the same name.
+	immutableCacheControl = "public, max-age=31536000, immutable"
+
+	// clfTimeFormat is the layout of the times in the access log.
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+	// httpTimeFormat is the layout of the times formatted by FormatTime.
+	httpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+	defaultMaxURLLength    = 8192
+	defaultMaxPathSegments = 128
+	defaultMaxGzipSize     = 1 << 20
+)
+
+// Default bodies of the 400 and 404 responses, so that clients show
+// more than an empty page.
+var (
+	badRequestBody = []byte("<html><body><h1>400 Bad Request</h1></body></html>\n")
+	notFoundBody   = []byte("<html><body><h1>404 Not Found</h1></body></html>\n")
 )
 
 type Server struct {
@@ -30,228 +95,2316 @@ type Server struct {
 
 	// DocRoot specifies the path to the directory to serve static files from.
 	DocRoot string
+
+	// TraversalStatus is the status returned for requests resolving
+	// outside of DocRoot. It can be 403 or 404, and defaults to 404.
+	TraversalStatus int
+
+	// maintenance is 1 in maintenance mode, see SetMaintenanceMode.
+	// It is accessed atomically, as it is switched while serving.
+	maintenance int32
+
+	// MaintenancePage is the path under DocRoot of a page, e.g.
+	// "maintenance.html", sent as the body of maintenance mode responses.
+	// It could be "", which means no body.
+	MaintenancePage string
+
+	// ReadSocketBuffer and WriteSocketBuffer set the size, in bytes, of
+	// the operating system's receive and send buffers of accepted
+	// connections. Zero keeps the system defaults.
+	ReadSocketBuffer  int
+	WriteSocketBuffer int
+
+	// RawRequestHook, if set, is called once per connection before the
+	// first request is read. It can peek at or consume bytes from br,
+	// e.g. for a custom handshake. If it returns an error, the
+	// connection is closed.
+	RawRequestHook func(br *bufio.Reader) error
+
+	// EnableManifest turns on a built-in endpoint returning a JSON
+	// manifest of all files under DocRoot, with their sizes and
+	// modification times.
+	EnableManifest bool
+
+	// ManifestPath is the URL path of the manifest endpoint.
+	// It defaults to "/manifest.json".
+	ManifestPath string
+
+	// ManifestTTL is how long a generated manifest is reused before
+	// DocRoot is walked again. It defaults to one minute.
+	ManifestTTL time.Duration
+
+	// EmitContentMD5 adds a Content-MD5 header, the base64 encoded MD5
+	// digest of the file, to 200 responses. Digests are cached until
+	// the file's modification time changes.
+	EmitContentMD5 bool
+
+	// PreloadHints maps URL paths of HTML files (e.g. "/index.html") to
+	// Link header values sent with them, e.g.
+	// "</style.css>; rel=preload; as=style".
+	PreloadHints map[string][]string
+
+	// FixedEncodings maps file path suffixes (e.g. ".br") to the
+	// Content-Encoding (e.g. "br") of files stored already encoded.
+	// Such files are served with that encoding, and the Content-Type
+	// of the file name without the suffix.
+	FixedEncodings map[string]string
+
+	// LanguageVariants enables picking a language variant of the requested
+	// file, e.g. "index.fr.html" for "index.html", based on the client's
+	// Accept-Language header.
+	LanguageVariants bool
+
+	// DefaultLanguage is the language of the variant served when none
+	// of the client's languages is available, e.g. "en". If "" or if
+	// that variant doesn't exist either, the requested file is served.
+	DefaultLanguage string
+
+	// CanonicalizeIndex redirects explicit requests for index files,
+	// e.g. "/dir/index.html", to their directory form, e.g. "/dir/".
+	CanonicalizeIndex bool
+
+	// ServePrecompressed serves a precompressed sibling of the requested
+	// file, "<file>.br" or "<file>.gz", when it exists and the client
+	// accepts its encoding. Brotli is preferred over gzip.
+	ServePrecompressed bool
+
+	// EnableGzip compresses the bodies of text files, e.g. HTML, CSS and
+	// JavaScript, with gzip for clients that accept it. The compressed
+	// body is built in memory, to send its Content-Length.
+	EnableGzip bool
+
+	// MaxGzipSize is the size of the largest file compressed with
+	// EnableGzip, larger ones are sent as is. If zero, 1MB is used.
+	MaxGzipSize int64
+
+	// MaxInFlightBodyBytes, if not zero, caps the total size of the
+	// response bodies built in memory, i.e. compressed with EnableGzip,
+	// across the connections being served. A response that would exceed
+	// it streams the file uncompressed instead. Bodies shared between
+	// responses, e.g. of the snapshot, aren't counted.
+	MaxInFlightBodyBytes int64
+
+	// DefaultFavicon, if set, is the icon served for "/favicon.ico"
+	// when DocRoot has none, instead of a 404 Not Found. With TryFiles,
+	// it is only served if none of them exists.
+	DefaultFavicon []byte
+
+	// DirectoryListing serves an HTML page listing the entries of a
+	// requested directory, e.g. "/dir/", that has no index.html.
+	DirectoryListing bool
+
+	// Tracer, if set, starts a tracing span around the handling of
+	// each valid request.
+	Tracer Tracer
+
+	// SupportHTTP09 enables serving HTTP/0.9 simple requests, e.g.
+	// "GET /index.html" with no version, with the bare file content and
+	// no status line or headers. Otherwise they get a 400 response.
+	SupportHTTP09 bool
+
+	// MaxResponseHeaders and MaxResponseHeaderBytes limit the number of
+	// headers of a response and their total size in bytes. A response
+	// exceeding them is replaced by a 500 and the connection is closed.
+	// Zero means the defaults of 100 headers and 64KB.
+	MaxResponseHeaders     int
+	MaxResponseHeaderBytes int
+
+	// SnapshotAtStartup makes ListenAndServe load the metadata and
+	// content of every file under DocRoot into memory before serving.
+	// Requests are then served from this snapshot only, unaffected by
+	// later changes to DocRoot. DocRoot has to fit in memory.
+	SnapshotAtStartup bool
+
+	// snapshot maps absolute paths under DocRoot to their entries,
+	// if SnapshotAtStartup is set. It is read-only once serving starts.
+	snapshot map[string]snapshotEntry
+
+	// snapshotTime is when the snapshot was taken, to compute the
+	// Age of the responses served from it.
+	snapshotTime time.Time
+
+	// statFile and openFile, if set, replace os.Stat and os.Open for the
+	// files under DocRoot, so that tests can observe how often files are
+	// stat'ed and read.
+	statFile func(name string) (os.FileInfo, error)
+	openFile func(name string) (io.ReadCloser, error)
+
+	// MaxURLLength is the longest request URL accepted, in bytes.
+	// Longer URLs get a 414 URI Too Long. It defaults to 8192.
+	MaxURLLength int
+
+	// MaxHeaderBytes is the largest size accepted for the headers of a
+	// request, in bytes, the request line aside, which is limited by
+	// MaxURLLength. Larger headers get a 431 Request Header Fields Too
+	// Large. It defaults to 8KB.
+	MaxHeaderBytes int
+
+	// MaxPathSegments is the largest number of segments accepted in
+	// a request URL path, e.g. 2 for "/a/b". URLs with more segments
+	// get a 400 Bad Request. It defaults to 128.
+	MaxPathSegments int
+
+	// ImmutablePattern, if set, matches the request paths of files
+	// whose content never changes under the same name, e.g.
+	// `\.[0-9a-f]{8,}\.(js|css)$` for fingerprinted assets. They are
+	// served with Cache-Control: public, max-age=31536000, immutable.
+	ImmutablePattern *regexp.Regexp
+
+	// FollowSymlinks serves files through symlinks leading outside
+	// DocRoot. Otherwise they get a 404 Not Found, so that a symlink
+	// can't expose other files of the machine. Symlinks to files
+	// under DocRoot are always followed.
+	FollowSymlinks bool
+
+	// TryFiles, if set, lists the paths under DocRoot tried in order
+	// for every request, like the try_files directive of nginx, e.g.
+	// {"$uri", "/index.html"} for a single-page application. "$uri" is
+	// replaced by the request path, and the first file that exists is
+	// served. If none does, the response is a 404 Not Found.
+	TryFiles []string
+
+	// CloseAfterLargeResponse, if not zero, closes the connection after
+	// any response whose Content-Length is larger, in bytes, so that a
+	// client slowly draining a large download can't keep it for more.
+	// Such responses are sent with Connection: close.
+	CloseAfterLargeResponse int64
+
+	// MaxConnLifetime, if not zero, is how long a connection may stay
+	// open, however busy. Once it elapses, a connection waiting for a
+	// request is closed, and one with a request already received is
+	// closed after its response, sent with Connection: close.
+	MaxConnLifetime time.Duration
+
+	// MaxConns, if not zero, is the largest number of connections
+	// handled at once by Serve. Further connections wait to be
+	// accepted until one of them is closed.
+	MaxConns int
+
+	// RequireUserAgent rejects requests with a missing or empty
+	// User-Agent header with a 400 Bad Request, e.g. to block bots.
+	RequireUserAgent bool
+
+	// NotFoundRedirect, if set, is the URL that requests for missing
+	// files are redirected to with a 302 Found, e.g. a search page,
+	// instead of getting a 404 Not Found.
+	NotFoundRedirect string
+
+	// NotFoundRedirectParam, if set, is the name of the query parameter
+	// added to NotFoundRedirect with the path of the missing file,
+	// e.g. "q" for "/search?q=%2Fmissing.html".
+	NotFoundRedirectParam string
+
+	// NotFoundFile, if set, is the path under DocRoot of a page, e.g.
+	// "404.html", sent as the body of 404 Not Found responses.
+	// It is cached in memory, and only read again once modified.
+	// If it can't be read, 404 responses have the default body.
+	NotFoundFile string
+
+	// ReadTimeout is how long the server waits for each request on a
+	// connection, re-armed before every request. A client that doesn't
+	// send a whole request in time is disconnected. It defaults to 5s.
+	ReadTimeout time.Duration
+
+	// CopyBufferSize, if not zero, is the size in bytes of the buffer
+	// used to copy files to connections. Zero lets the copy pick its
+	// buffer, 32KB, or use sendfile when the platform supports it.
+	CopyBufferSize int
+
+	// LargeFileHint, if not zero, is the size in bytes above which files
+	// are served with hints to the OS, where supported (posix_fadvise on
+	// Linux), that they are read once, sequentially: the OS reads ahead
+	// more, and drops them from its page cache once sent, instead of
+	// evicting smaller, more often requested files.
+	LargeFileHint int64
+
+	// HeadersByStatus maps status codes to headers added to every
+	// response with that status, e.g. {404: {"Cache-Control": "no-store"}}.
+	// They replace the headers of the same name set by the server.
+	HeadersByStatus map[int]map[string]string
+
+	// Logger receives the diagnostic messages of the server, e.g. about
+	// failed connections. If nil, the log package's standard logger is
+	// used, which writes to the standard error.
+	Logger *log.Logger
+
+	// Debug enables debug messages, e.g. one per accepted connection.
+	Debug bool
+
+	// ArtificialLatency is the minimum time between receiving a request
+	// and writing its response, to test how clients cope with slow
+	// servers. It only applies with Debug, so that it isn't enabled
+	// by accident.
+	ArtificialLatency time.Duration
+
+	// AccessLog, if set, receives a line in the Common Log Format for
+	// every request answered, with "-" for the request line of those
+	// that couldn't be read, e.g.
+	// 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /index.html HTTP/1.1" 200 2326
+	AccessLog io.Writer
+
+	// CombinedLog writes the AccessLog lines in the Combined Log Format,
+	// which adds the Referer and User-Agent of the request, e.g.
+	// ... "GET / HTTP/1.1" 200 2326 "http://example.com/" "curl/7.79.1"
+	CombinedLog bool
+
+	// LogRequestBodySize appends the size of the request body, e.g. of
+	// an upload, to the AccessLog lines, or "-" if there is none.
+	LogRequestBodySize bool
+
+	// accessLogMu serializes the lines written to AccessLog by the
+	// connections.
+	accessLogMu sync.Mutex
+
+	manifestMu   sync.Mutex
+	manifestBody []byte
+	manifestTime time.Time
+
+	md5Mu    sync.Mutex
+	md5Cache map[string]md5Entry
+
+	pageMu    sync.Mutex
+	pageCache map[string]pageEntry
+
+	charsetMu    sync.Mutex
+	charsetCache map[string]charsetEntry
+
+	// rootOnce resolves the symlinks of DocRoot once, see
+	// resolvedDocRoot.
+	rootOnce     sync.Once
+	rootResolved string
+	rootErr      error
+
+	// inFlightBodyBytes is the total size of the bodies built in memory
+	// for the responses being written, see MaxInFlightBodyBytes.
+	inFlightMu        sync.Mutex
+	inFlightBodyBytes int64
+
+	// mu guards the listeners and connections being served, so that
+	// Shutdown can close them. conns tells whether each connection is
+	// idle, waiting for the client to start a request.
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	conns        map[net.Conn]bool
+	shuttingDown bool
+
+	// connWG counts the connections being served.
+	connWG sync.WaitGroup
+}
+
+// snapshotEntry is a file or directory in the DocRoot snapshot.
+type snapshotEntry struct {
+	info os.FileInfo
+	data []byte // nil for directories
+}
+
+// md5Entry is a cached Content-MD5 value of a file.
+type md5Entry struct {
+	modTime time.Time
+	sum     string
+}
+
+// charsetEntry is the cached charset of a text file, given by its
+// byte order mark, or "" if it has none.
+type charsetEntry struct {
+	modTime time.Time
+	charset string
+}
+
+// pageEntry is the cached content of a page, such as NotFoundFile.
+type pageEntry struct {
+	modTime time.Time
+	body    []byte
+}
+
+// manifestEntry describes a single file in the DocRoot manifest.
+type manifestEntry struct {
+	Path    string    `json:"path"` // e.g. "/subdir/index.html"
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// SpanContext identifies a tracing span, e.g. in the W3C Trace Context
+// format used by OpenTelemetry.
+type SpanContext struct {
+	TraceID string
+	SpanID  string
+}
+
+// Tracer integrates the server with a distributed tracing system,
+// without the server depending on it.
+type Tracer interface {
+	// StartSpan starts a span for handling req. The returned function
+	// ends the span, given the status code of the response.
+	StartSpan(req *Request) (SpanContext, func(status int))
+}
+
+// socketBufferSetter is implemented by connections whose socket
+// buffer sizes can be tuned, such as *net.TCPConn.
+type socketBufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// ListenAndServe listens on the TCP network address s.Addr and then
+// handles requests on incoming connections.
+func (s *Server) ListenAndServe() error {
+	// Hint: call HandleConnection
+	if err := s.ValidateServerSetup(); err != nil {
+		return fmt.Errorf("server is not setup correctly %v", err)
+	}
+	if s.SnapshotAtStartup {
+		if err := s.takeSnapshot(); err != nil {
+			return fmt.Errorf("failed to snapshot doc root %v", err)
+		}
+	}
+
+	// server should now start to listen on the configured address
+	ln, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	// Serve closes the listener when it returns
+	return s.Serve(ln)
+}
+
+// Serve accepts incoming connections on ln and handles requests on them.
+// It returns nil once ln is closed, and always closes ln before returning.
+func (s *Server) Serve(ln net.Listener) error {
+	// ln may already be closed, e.g. by Shutdown
+	defer ln.Close()
+	if !s.trackListener(ln) {
+		// The server is already shut down
+		return nil
+	}
+	defer s.untrackListener(ln)
+
+	// tempDelay is how long to wait after a failed Accept, doubled on
+	// every failure in a row, so that a lasting error, e.g. too many
+	// open files, doesn't keep a CPU busy
+	var tempDelay time.Duration
+
+	// sem holds a slot for every connection being handled, if limited
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
+	release := func() {
+		if sem != nil {
+			<-sem
+		}
+	}
+
+	// accept connections until the listener is closed
+	for {
+		// Connections beyond the limit wait in the listen backlog
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			release()
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if tempDelay == 0 {
+				tempDelay = minAcceptDelay
+			} else if tempDelay *= 2; tempDelay > maxAcceptDelay {
+				tempDelay = maxAcceptDelay
+			}
+			s.logf("Failed to accept connection: %v; retrying in %v", err, tempDelay)
+			time.Sleep(tempDelay)
+			continue
+		}
+		tempDelay = 0
+		s.debugf("Accepted connection from %v", conn.RemoteAddr())
+		if err := s.setSocketBuffers(conn); err != nil {
+			s.logf("Failed to set socket buffers for connection %v: %v", conn.RemoteAddr(), err)
+		}
+		if !s.trackConn(conn) {
+			release()
+			_ = conn.Close()
+			return nil
+		}
+		go func() {
+			defer release()
+			defer s.untrackConn(conn)
+			s.HandleConnection(conn)
+		}()
+	}
+}
+
+// Shutdown gracefully stops the server. It closes the listeners, so
+// that no new connection is accepted, then waits for the connections
+// being served to finish, and Serve and ListenAndServe return nil.
+// Idle connections are closed right away, and the others after their
+// current response, which tells the client so. If ctx expires first, the remaining connections are closed, and
+// the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.shuttingDown = true
+	var err error
+	for ln := range s.listeners {
+		if cerr := ln.Close(); cerr != nil && !errors.Is(cerr, net.ErrClosed) && err == nil {
+			err = cerr
+		}
+	}
+	for conn, idle := range s.conns {
+		if idle {
+			// Interrupt the wait for the next request
+			_ = conn.SetReadDeadline(time.Now())
+		}
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.connWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		s.mu.Lock()
+		for conn := range s.conns {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// trackListener records ln for Shutdown to close. It returns false
+// if the server is shutting down.
+func (s *Server) trackListener(ln net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[ln] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(ln net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, ln)
+}
+
+// trackConn records conn as being served, for Shutdown to wait for.
+// It returns false if the server is shutting down.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]bool)
+	}
+	s.conns[conn] = false
+	s.connWG.Add(1)
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.connWG.Done()
+}
+
+// markIdle marks conn as waiting for the next request, and sets its
+// read deadline. It returns false if the server is shutting down, in
+// which case conn should be closed instead.
+func (s *Server) markIdle(conn net.Conn, deadline time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown {
+		return false, nil
+	}
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = true
+	}
+	return true, conn.SetReadDeadline(deadline)
+}
+
+// markBusy marks conn as reading a request, and sets its read deadline
+// again, as Shutdown may have cut it short while conn was idle.
+func (s *Server) markBusy(conn net.Conn, deadline time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = false
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.shuttingDown
+}
+
+// SetMaintenanceMode switches maintenance mode on or off. In maintenance
+// mode, the server answers every valid request with a 503 Service
+// Unavailable, without resolving any file. It can be called while
+// the server is serving.
+func (s *Server) SetMaintenanceMode(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&s.maintenance, v)
+}
+
+// MaintenanceMode reports whether the server is in maintenance mode.
+func (s *Server) MaintenanceMode() bool {
+	return atomic.LoadInt32(&s.maintenance) == 1
+}
+
+func (s *Server) ValidateServerSetup() error {
+	// Validating the doc root of the server
+	directory, err := os.Stat(s.DocRoot)
+
+	if os.IsNotExist(err) {
+		return err
+	}
+
+	if !directory.IsDir() {
+		return errors.New("DocRoot not a directory")
+	}
+
+	return nil
+}
+
+// takeSnapshot loads the metadata and content of all the files and
+// directories under DocRoot into s.snapshot. Symlinks are followed
+// as s.stat does.
+func (s *Server) takeSnapshot() error {
+	root, err := s.docRoot()
+	if err != nil {
+		return err
+	}
+	// filepath.Walk doesn't follow DocRoot itself if it is a symlink
+	resolved, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	snapshotTime := time.Now()
+	snapshot := make(map[string]snapshotEntry)
+	if err := s.snapshotDir(snapshot, root, resolved, nil); err != nil {
+		return err
+	}
+	s.snapshot = snapshot
+	s.snapshotTime = snapshotTime
+	return nil
+}
+
+// snapshotDir adds the directory dir, whose symlinks are resolved, and
+// everything under it to snapshot, as if dir was at the path name.
+// parents are the directories being added already, which symlinks
+// mustn't loop back to.
+func (s *Server) snapshotDir(snapshot map[string]snapshotEntry, name, dir string, parents []string) error {
+	parents = append(parents, dir)
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.Join(name, rel)
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !s.FollowSymlinks && !s.insideDocRoot(key) {
+				return nil
+			}
+			target, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				// A dangling symlink doesn't exist
+				return nil
+			}
+			if info, err = os.Stat(target); err != nil {
+				return nil
+			}
+			if info.IsDir() {
+				for _, p := range parents {
+					if insideDir(p, target) {
+						return nil
+					}
+				}
+				return s.snapshotDir(snapshot, key, target, parents)
+			}
+			path = target
+		}
+		entry := snapshotEntry{info: info}
+		if info.Mode().IsRegular() {
+			if entry.data, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		} else if !info.IsDir() {
+			return nil
+		}
+		snapshot[key] = entry
+		return nil
+	})
+}
+
+// stat returns the FileInfo of the file at the absolute path,
+// from the snapshot if there is one. Whether its symlinks may be
+// followed is checked by servable, once the file to serve is picked.
+func (s *Server) stat(path string) (os.FileInfo, error) {
+	if s.snapshot == nil {
+		if s.statFile != nil {
+			return s.statFile(path)
+		}
+		return os.Stat(path)
+	}
+	entry, ok := s.snapshot[path]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return entry.info, nil
+}
+
+// docRoot returns the absolute path of DocRoot.
+func (s *Server) docRoot() (string, error) {
+	root := s.DocRoot
+	if root == "" {
+		root = "testdata/"
+	}
+	return filepath.Abs(root)
+}
+
+// servable reports whether the file at the absolute path may be
+// served: unless FollowSymlinks is set, its symlinks mustn't lead
+// outside DocRoot. The snapshot only holds files that may be served.
+func (s *Server) servable(path string) bool {
+	return s.snapshot != nil || s.FollowSymlinks || s.insideDocRoot(path)
+}
+
+// insideDocRoot reports whether the file at the absolute path is
+// under DocRoot once its symlinks are resolved. A path that can't be
+// resolved, e.g. of a missing file, is left to fail when stat'ed.
+func (s *Server) insideDocRoot(path string) bool {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return true
+	}
+	root, err := s.resolvedDocRoot()
+	if err != nil {
+		return false
+	}
+	return insideDir(resolved, root)
+}
+
+// resolvedDocRoot returns the absolute path of DocRoot with its
+// symlinks resolved, e.g. of /tmp on macOS. It is resolved once.
+func (s *Server) resolvedDocRoot() (string, error) {
+	s.rootOnce.Do(func() {
+		root, err := s.docRoot()
+		if err == nil {
+			root, err = filepath.EvalSymlinks(root)
+		}
+		s.rootResolved, s.rootErr = root, err
+	})
+	return s.rootResolved, s.rootErr
+}
+
+// isPathSafe reports whether the decoded request path requested stays
+// under docRoot, an absolute path, once joined to it. Its ".." segments
+// are resolved first, so that "/a/../b" is safe, but "/../b" and
+// "/a/../../b" aren't, instead of being cleaned up to the root.
+func isPathSafe(docRoot, requested string) bool {
+	if !strings.HasPrefix(requested, "/") || strings.ContainsAny(requested, "\\\x00") {
+		return false
+	}
+	cleaned := path.Clean(strings.TrimPrefix(requested, "/"))
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return false
+	}
+	return insideDir(filepath.Join(docRoot, filepath.FromSlash(cleaned)), docRoot)
+}
+
+// directoryLocation returns the Location of a redirect to the directory
+// at the decoded request path dir, e.g. "/my%20dir/" for "/my dir".
+// The path is cleaned to have a single leading slash, as "//host/"
+// would send the client to another host.
+func directoryLocation(dir string) string {
+	dir = path.Clean("/" + dir)
+	if dir != "/" {
+		dir += "/"
+	}
+	return (&url.URL{Path: dir}).EscapedPath()
+}
+
+// insideDir reports whether the cleaned, absolute path is dir or is
+// under it. Paths are compared on separators, so that e.g. "/srv/www2"
+// isn't inside "/srv/www".
+func insideDir(path, dir string) bool {
+	if path == dir {
+		return true
+	}
+	prefix := dir
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	return strings.HasPrefix(path, prefix)
+}
+
+// open opens the file at the absolute path for reading,
+// from the snapshot if there is one.
+func (s *Server) open(path string) (io.ReadCloser, error) {
+	if s.snapshot == nil {
+		if s.openFile != nil {
+			return s.openFile(path)
+		}
+		return os.Open(path)
+	}
+	entry, ok := s.snapshot[path]
+	if !ok || entry.data == nil {
+		return nil, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(entry.data)), nil
+}
+
+// setSocketBuffers applies the configured socket buffer sizes to conn.
+// Connections that don't support tuning their buffers are left as is.
+func (s *Server) setSocketBuffers(conn net.Conn) error {
+	sc, ok := conn.(socketBufferSetter)
+	if !ok {
+		return nil
+	}
+	if s.ReadSocketBuffer > 0 {
+		if err := sc.SetReadBuffer(s.ReadSocketBuffer); err != nil {
+			return err
+		}
+	}
+	if s.WriteSocketBuffer > 0 {
+		if err := sc.SetWriteBuffer(s.WriteSocketBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HandleConnection reads requests from the accepted conn and handles them.
+func (s *Server) HandleConnection(conn net.Conn) {
+	opened := time.Now()
+	br := bufio.NewReader(conn)
+	if s.RawRequestHook != nil {
+		// The hook reads from the client too, so it gets the same timeout
+		if err := conn.SetReadDeadline(s.readDeadline(opened)); err != nil {
+			s.logf("Failed to set timeout for connection %v", conn)
+			_ = conn.Close()
+			return
+		}
+		if err := s.RawRequestHook(br); err != nil {
+			s.logf("Raw request hook failed for %v: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+	}
+	for {
+		// Set timeout, unless the server is shutting down
+		ok, err := s.markIdle(conn, s.readDeadline(opened))
+		if err != nil {
+			s.logf("Failed to set timeout for connection %v", conn)
+			_ = conn.Close()
+			return
+		}
+		if !ok {
+			s.logf("Closing connection to %v on shutdown", conn.RemoteAddr())
+			_ = conn.Close()
+			return
+		}
+
+		// Once the client starts a request, Shutdown lets it finish.
+		// An error is left for readRequest to report
+		if _, err := br.Peek(1); err == nil {
+			if err := s.markBusy(conn, s.readDeadline(opened)); err != nil {
+				s.logf("Failed to set timeout for connection %v", conn)
+				_ = conn.Close()
+				return
+			}
+		}
+
+		// Read next request from the client
+		req, bytesReceived, err := readRequest(br, s.maxHeaderBytes(), s.maxURLLength())
+
+		// Handle EOF, a partial request followed by EOF is a bad request
+		if errors.Is(err, io.EOF) && !bytesReceived {
+			s.logf("Connection closed by %v", conn.RemoteAddr())
+			_ = conn.Close()
+			return
+		}
+
+		// timeout in this application means we close the connection,
+		// telling the client first if it stalled in the middle of a request
+		if err, ok := err.(net.Error); ok && err.Timeout() {
+			s.logf("Connection to %v timed out", conn.RemoteAddr())
+			if bytesReceived {
+				res := &Response{}
+				res.HandleRequestTimeout()
+				s.writeUnreadResponse(conn, res)
+			}
+			_ = conn.Close()
+			return
+		}
+
+		// The client keeps sending headers, the rest of them is ignored
+		if errors.Is(err, errRequestHeadersTooLarge) {
+			s.logf("Handle request with too large headers from %v", conn.RemoteAddr())
+			res := &Response{}
+			res.HandleHeaderTooLarge()
+			s.writeUnreadResponse(conn, res)
+			_ = conn.Close()
+			return
+		}
+
+		// The rest of the request line is left unread
+		if errors.Is(err, errURITooLong) {
+			s.logf("Handle request with too long URI from %v", conn.RemoteAddr())
+			res := &Response{}
+			res.HandleURITooLong(&Request{Close: true})
+			s.writeUnreadResponse(conn, res)
+			_ = conn.Close()
+			return
+		}
+
+		// A well-formed request with an unsupported method
+		if errors.Is(err, errMethodNotAllowed) {
+			s.logf("Handle request with unsupported method: %v", err)
+			res := &Response{}
+			res.HandleMethodNotAllowed()
+			s.writeUnreadResponse(conn, res)
+			_ = conn.Close()
+			return
+		}
+
+		// Handle the malformed request and immediately close the connection and return
+		if err != nil {
+			s.logf("Handle bad request for error: %v", err)
+			res := &Response{}
+			res.HandleBadRequest()
+			s.writeUnreadResponse(conn, res)
+			_ = conn.Close()
+			return
+		}
+
+		if req.Proto == http09Proto {
+			s.handleSimpleRequest(conn, req)
+			_ = conn.Close()
+			return
+		}
+
+		// The request is logged as received, before it is resolved
+		received := time.Now()
+		if s.MaxConnLifetime > 0 && received.Sub(opened) >= s.MaxConnLifetime {
+			// A request pipelined in br may still be read past the deadline.
+			// The connection is closed after this response, as the client is told
+			req.Close = true
+		}
+		if s.isShuttingDown() {
+			// Tell the client not to send another request
+			req.Close = true
+		}
+		requestLine := req.Method + " " + req.URL + " " + req.Proto
+
+		status, bodyBytes, closeConn, err := s.writeResponse(conn, req, received)
+		s.logAccess(conn.RemoteAddr(), received, req, requestLine, status, bodyBytes)
+		if err != nil {
+			// The client is likely gone, or was sent a 500 instead
+			s.logf("Failed to write response to %v: %v", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			return
+		}
+		if closeConn {
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+// readDeadline returns the deadline to read the next request on a
+// connection opened at the given time: ReadTimeout from now, but no
+// later than the end of MaxConnLifetime.
+func (s *Server) readDeadline(opened time.Time) time.Time {
+	deadline := time.Now().Add(s.readTimeout())
+	if s.MaxConnLifetime > 0 {
+		if end := opened.Add(s.MaxConnLifetime); end.Before(deadline) {
+			return end
+		}
+	}
+	return deadline
+}
+
+// writeUnreadResponse writes res, the response to a request that
+// couldn't be read, to conn, and logs it to AccessLog with "-" for
+// the request line.
+func (s *Server) writeUnreadResponse(conn net.Conn, res *Response) {
+	received := time.Now()
+	s.addStatusHeaders(res)
+	_ = res.Write(conn)
+	s.logAccess(conn.RemoteAddr(), received, nil, "-", res.StatusCode, res.bodyBytes)
+}
+
+// writeResponse handles the valid req, received at the given time, and
+// writes its response to w. w needn't be a connection: setting its
+// deadlines and closing it are left to the caller. It returns the
+// status and the number of body bytes of the response written, and
+// whether the connection must be closed after it.
+func (s *Server) writeResponse(w io.Writer, req *Request, received time.Time) (status int, bodyBytes int64, closeConn bool, err error) {
+	// Responses are pooled, as one is needed for every request
+	res := responsePool.Get().(*Response)
+	defer func() {
+		s.releaseBody(res)
+		res.Reset()
+		responsePool.Put(res)
+	}()
+	s.handleGoodRequest(req, res)
+	if req.Proto == http10Proto && !req.Close {
+		// An HTTP/1.0 client only reuses the connection if told so
+		res.Header["Connection"] = "keep-alive"
+	}
+	if s.CloseAfterLargeResponse > 0 {
+		// A slow client can't keep the connection for another large response
+		n, err := strconv.ParseInt(res.Header["Content-Length"], 10, 64)
+		if err == nil && n > s.CloseAfterLargeResponse {
+			res.Header["Connection"] = "close"
+		}
+	}
+	// The client is told the connection is closed, or asked for it
+	closeConn = req.Close || res.Header["Connection"] == "close"
+	res.maxHeaders = s.MaxResponseHeaders
+	res.maxHeaderBytes = s.MaxResponseHeaderBytes
+	res.copyBufferSize = s.CopyBufferSize
+	res.largeFileHint = s.LargeFileHint
+	if s.Debug && s.ArtificialLatency > 0 {
+		time.Sleep(time.Until(received.Add(s.ArtificialLatency)))
+	}
+	err = res.Write(w)
+	if errors.Is(err, errResponseHeadersTooLarge) {
+		// Nothing is written yet, so the client can still be told
+		errRes := &Response{}
+		errRes.HandleInternalError(req)
+		errRes.Header["Connection"] = "close"
+		s.addStatusHeaders(errRes)
+		_ = errRes.Write(w)
+		return errRes.StatusCode, 0, true, err
+	}
+	return res.StatusCode, res.bodyBytes, closeConn, err
+}
+
+// logf logs a diagnostic message to Logger.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+	s.Logger.Printf(format, v...)
+}
+
+// debugf logs a debug message to Logger, if Debug is enabled.
+func (s *Server) debugf(format string, v ...interface{}) {
+	if s.Debug {
+		s.logf(format, v...)
+	}
+}
+
+// addStatusHeaders adds the HeadersByStatus configured for the status
+// of res to its headers.
+func (s *Server) addStatusHeaders(res *Response) {
+	for k, v := range s.HeadersByStatus[res.StatusCode] {
+		res.Header[CanonicalHeaderKey(k)] = v
+	}
+}
+
+// logAccess writes the Common Log Format line of req to AccessLog, if
+// set, or its Combined Log Format line with CombinedLog. requestLine is
+// the request line of req as received, or "-" if req is nil because it
+// couldn't be read. bodyBytes is the size of the response body written.
+func (s *Server) logAccess(addr net.Addr, received time.Time, req *Request, requestLine string, status int, bodyBytes int64) {
+	if s.AccessLog == nil {
+		return
+	}
+	host := "-"
+	if addr != nil {
+		if h, _, err := net.SplitHostPort(addr.String()); err == nil && h != "" {
+			host = h
+		}
+	}
+	size := "-"
+	if bodyBytes > 0 {
+		size = strconv.FormatInt(bodyBytes, 10)
+	}
+	line := fmt.Sprintf("%v - - [%v] %q %v %v",
+		host, received.Format(clfTimeFormat), requestLine, status, size)
+	if s.CombinedLog {
+		referer, userAgent := "", ""
+		if req != nil {
+			referer, userAgent = req.Referer(), req.Header["User-Agent"]
+		}
+		line += fmt.Sprintf(" %v %v", logField(referer), logField(userAgent))
+	}
+	if s.LogRequestBodySize {
+		reqSize := "-"
+		if req != nil && req.BodyBytes > 0 {
+			reqSize = strconv.FormatInt(req.BodyBytes, 10)
+		}
+		line += " " + reqSize
+	}
+	line += "\n"
+
+	s.accessLogMu.Lock()
+	defer s.accessLogMu.Unlock()
+	if _, err := io.WriteString(s.AccessLog, line); err != nil {
+		s.logf("Failed to write access log: %v", err)
+	}
+}
+
+// logField quotes the header value v for the access log, or returns "-"
+// if it is empty.
+func logField(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strconv.Quote(v)
+}
+
+// handleSimpleRequest handles the HTTP/0.9 simple request req, writing
+// only the requested file's content to conn, or nothing if it can't be
+// served. The caller closes conn afterwards, which ends the response.
+func (s *Server) handleSimpleRequest(conn net.Conn, req *Request) {
+	if !s.SupportHTTP09 {
+		s.logf("Handle bad request for unsupported HTTP/0.9 request from %v", conn.RemoteAddr())
+		res := &Response{}
+		res.HandleBadRequest()
+		s.writeUnreadResponse(conn, res)
+		return
+	}
+	res := s.HandleGoodRequest(req)
+	if res.StatusCode != statusOK {
+		return
+	}
+	res.copyBufferSize = s.CopyBufferSize
+	res.largeFileHint = s.LargeFileHint
+	if err := res.WriteBody(conn); err != nil {
+		s.logf("Failed to write response to %v: %v", conn.RemoteAddr(), err)
+	}
+}
+
+// tryFiles returns the absolute path of the first of TryFiles that is
+// a file under root, once "$uri" is replaced by requestPath, or ""
+// if there is none. Like request URLs, a path ending in "/" stands
+// for the index.html of the directory.
+func (s *Server) tryFiles(requestPath, root string) string {
+	for _, template := range s.TryFiles {
+		p := strings.ReplaceAll(template, "$uri", requestPath)
+		if strings.HasSuffix(p, "/") {
+			p += "index.html"
+		}
+		// Cleaning the rooted path keeps it under root
+		candidate := filepath.Join(root, filepath.FromSlash(path.Clean("/"+p)))
+		if info, err := s.stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// handleNotFound prepares res for a request for the missing file at
+// requestPath: a redirect if NotFoundRedirect is set, or a 404 otherwise.
+// root is the absolute path of DocRoot.
+func (s *Server) handleNotFound(req *Request, res *Response, requestPath, root string) {
+	if s.NotFoundRedirect == "" {
+		s.handleNotFoundPage(req, res, root)
+		return
+	}
+	location := s.NotFoundRedirect
+	if s.NotFoundRedirectParam != "" {
+		sep := "?"
+		if strings.Contains(location, "?") {
+			sep = "&"
+		}
+		location += sep + url.QueryEscape(s.NotFoundRedirectParam) + "=" + url.QueryEscape(requestPath)
+	}
+	res.HandleFound(req, location)
+}
+
+// handleNotFoundPage prepares res to be a 404 Not Found response, with
+// NotFoundFile as the body if it is set. root is the absolute path of DocRoot.
+func (s *Server) handleNotFoundPage(req *Request, res *Response, root string) {
+	res.HandleNotFound(req)
+	if s.NotFoundFile != "" {
+		s.setPageBody(res, s.NotFoundFile, root)
+	}
+}
+
+// handleUnavailable prepares res to be a maintenance mode response,
+// with MaintenancePage as the body if it is set.
+func (s *Server) handleUnavailable(req *Request, res *Response) {
+	res.HandleUnavailable(req)
+	if s.MaintenancePage == "" {
+		return
+	}
+	root, err := s.docRoot()
+	if err != nil {
+		s.logf("Failed to resolve doc root %v: %v", s.DocRoot, err)
+		return
+	}
+	s.setPageBody(res, s.MaintenancePage, root)
+}
+
+// setPageBody makes the page at name, a path under root, the absolute
+// path of DocRoot, the body of res. If the page can't be read, res is
+// left as is.
+func (s *Server) setPageBody(res *Response, name, root string) {
+	page := filepath.Join(root, name)
+	if page == root || !insideDir(page, root) || !s.servable(page) {
+		s.logf("Page %v is not under %v", name, root)
+		return
+	}
+	body, err := s.page(page)
+	if err != nil {
+		s.logf("Failed to read page %v: %v", page, err)
+		return
+	}
+	res.FilePath = ""
+	res.Body = body
+	res.Header["Content-Length"] = strconv.Itoa(len(body))
+	res.Header["Content-Type"] = contentType(filepath.Ext(page))
+}
+
+// page returns the content of the page at path, reusing the cached
+// content if the page hasn't been modified since.
+func (s *Server) page(path string) ([]byte, error) {
+	info, err := s.stat(path)
+	if err != nil {
+		return nil, err
+	}
+	s.pageMu.Lock()
+	entry, ok := s.pageCache[path]
+	s.pageMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.body, nil
+	}
+
+	f, err := s.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	body, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	s.pageMu.Lock()
+	if s.pageCache == nil {
+		s.pageCache = make(map[string]pageEntry)
+	}
+	s.pageCache[path] = pageEntry{modTime: info.ModTime(), body: body}
+	s.pageMu.Unlock()
+	return body, nil
+}
+
+// notModifiedSince reports whether a file last modified at modTime is
+// not modified since the If-Modified-Since header value ims.
+// An empty or unparseable ims never matches, so the file is sent.
+func notModifiedSince(ims string, modTime time.Time) bool {
+	if ims == "" {
+		return false
+	}
+	t, err := time.Parse(httpTimeFormat, ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// responsePool holds Responses for reuse across requests.
+var responsePool = sync.Pool{
+	New: func() interface{} {
+		return &Response{}
+	},
+}
+
+// HandleGoodRequest handles the valid req and generates the corresponding res.
+func (s *Server) HandleGoodRequest(req *Request) (res *Response) {
+	res = &Response{}
+	s.handleGoodRequest(req, res)
+	// res isn't written by the server, so its body isn't accounted for
+	s.releaseBody(res)
+	return res
+}
+
+// handleGoodRequest handles the valid req, preparing res as the
+// corresponding response. res is expected to be new or reset.
+func (s *Server) handleGoodRequest(req *Request, res *Response) {
+	res.Request = req
+	defer s.addStatusHeaders(res)
+	if s.Tracer != nil {
+		_, end := s.Tracer.StartSpan(req)
+		defer func() { end(res.StatusCode) }()
+	}
+
+	// Hint: use the other methods below
+	if s.MaintenanceMode() {
+		s.handleUnavailable(req, res)
+		return
+	}
+	if s.RequireUserAgent && req.Header["User-Agent"] == "" {
+		res.HandleBadRequest()
+		return
+	}
+	if req.Method == "OPTIONS" {
+		// The same methods are allowed for every URL
+		res.HandleOptions(req)
+		return
+	}
+	if len(req.URL) > s.maxURLLength() {
+		res.HandleURITooLong(req)
+		return
+	}
+	if s.EnableManifest && req.URL == s.manifestPath() {
+		s.handleManifest(req, res)
+		return
+	}
+
+	// Files are looked up by the decoded path, e.g. "my file.txt" for
+	// "/my%20file.txt", and redirects escape it again
+	decoded, err := url.PathUnescape(req.URL)
+	if err != nil || !validUrl(decoded) || strings.Contains(decoded, "\x00") {
+		res.HandleBadRequest()
+		return
+	}
+	req.URL = decoded
+	// Segments are counted once decoded, as "%2F" is a slash too
+	if pathSegments(req.URL) > s.maxPathSegments() {
+		res.HandleBadRequest()
+		return
+	}
+
+	requestPath := req.URL
+	url := req.URL
+	l := len(url)
+	if url == "/" {
+		url = "/index.html"
+	} else if string(url[l-1]) == "/" {
+		url += "index.html"
+	}
+	urlPath := path.Clean(url)
+
+	directory, err2 := s.docRoot()
+	if err2 != nil {
+		res.HandleNotFound(req)
+		return
+	}
+	// The path is checked before it is joined to DocRoot
+	if !isPathSafe(directory, url) {
+		if s.TraversalStatus == statusForbidden {
+			res.HandleForbidden(req)
+		} else {
+			s.handleNotFoundPage(req, res, directory)
+		}
+		return
+	}
+	url = filepath.Join(directory, filepath.FromSlash(url))
+	req.URL = url
+	if len(s.TryFiles) > 0 {
+		// The first of TryFiles that exists is served instead
+		if url = s.tryFiles(requestPath, directory); url == "" {
+			if requestPath == "/favicon.ico" && s.DefaultFavicon != nil {
+				s.handleDefaultFavicon(req, res)
+				return
+			}
+			s.handleNotFound(req, res, requestPath, directory)
+			return
+		}
+	}
+	var lang string
+	if s.LanguageVariants {
+		if variant, l := s.languageVariant(url, req.Header["Accept-Language"]); variant != "" {
+			url, lang = variant, l
+		}
+	}
+
+	// The file is stat'ed only once per request, and the result is
+	// passed along to build the headers and write the body
+	info, err := s.stat(url)
+	if err == nil && info.IsDir() && !strings.HasSuffix(requestPath, "/") {
+		// Relative links in the directory resolve against "/dir/", so
+		// the client is sent there, never to another host as "//dir/" would
+		res.HandleMovedPermanently(req, directoryLocation(requestPath))
+		return
+	}
+	if err != nil || info.IsDir() {
+		if s.DirectoryListing && strings.HasSuffix(requestPath, "/") {
+			// url is the index.html of the requested directory
+			dir := filepath.Dir(url)
+			if dirInfo, err := s.stat(dir); err == nil && dirInfo.IsDir() && s.servable(dir) {
+				s.handleDirectoryListing(req, res, requestPath, dir, dirInfo)
+				return
+			}
+		}
+		if requestPath == "/favicon.ico" && s.DefaultFavicon != nil {
+			s.handleDefaultFavicon(req, res)
+			return
+		}
+		s.handleNotFound(req, res, requestPath, directory)
+		return
+	}
+	if s.CanonicalizeIndex && !strings.HasSuffix(requestPath, "/") &&
+		path.Base(requestPath) == "index.html" && info.Mode().IsRegular() {
+		// Only an index file that exists is redirected, to its directory
+		res.HandleMovedPermanently(req, directoryLocation(path.Dir(requestPath)))
+		return
+	}
+
+	res.HandleOK(req, url, info)
+	if s.ImmutablePattern != nil && s.ImmutablePattern.MatchString(requestPath) {
+		res.Header["Cache-Control"] = immutableCacheControl
+	}
+	if s.LanguageVariants {
+		addVary(res.Header, "Accept-Language")
+		if lang != "" {
+			res.Header["Content-Language"] = lang
+		}
+	}
+	if suffix, encoding := s.fixedEncoding(url); encoding != "" {
+		res.Header["Content-Encoding"] = encoding
+		res.Header["Content-Type"] = contentType(filepath.Ext(strings.TrimSuffix(url, suffix)))
+	} else if s.ServePrecompressed {
+		addVary(res.Header, "Accept-Encoding")
+		if sibling, encoding, sinfo := s.precompressedSibling(url, req.Header["Accept-Encoding"]); sibling != "" {
+			// From here on, the sibling is the file served
+			url, info = sibling, sinfo
+			res.FilePath = url
+			res.Header["Content-Length"] = strconv.FormatInt(info.Size(), 10)
+			res.Header["Last-Modified"] = FormatTime(info.ModTime())
+			res.Header["Content-Encoding"] = encoding
+		}
+	}
+	if !s.servable(url) {
+		// Only the file picked is checked, not every candidate stat'ed
+		s.handleNotFound(req, res, requestPath, directory)
+		return
+	}
+	if notModifiedSince(req.Header["If-Modified-Since"], info.ModTime()) {
+		// The headers picking and caching the file still apply to the 304
+		vary, cacheControl := res.Header["Vary"], res.Header["Cache-Control"]
+		res.HandleNotModified(req, info)
+		if vary != "" {
+			res.Header["Vary"] = vary
+		}
+		if cacheControl != "" {
+			res.Header["Cache-Control"] = cacheControl
+		}
+		return
+	}
+	if ct := res.Header["Content-Type"]; strings.HasPrefix(ct, "text/") && res.Header["Content-Encoding"] == "" {
+		// A byte order mark tells the charset better than the extension.
+		// It is sniffed for HEAD too, to send the same headers as GET.
+		if charset := s.bomCharset(url, info); charset != "" {
+			mediaType := strings.TrimSpace(strings.SplitN(ct, ";", 2)[0])
+			res.Header["Content-Type"] = mediaType + "; charset=" + charset
+		}
+	}
+	if header := req.Header["Range"]; header != "" {
+		// Invalid ranges are ignored, and so are multiple ranges, which
+		// would need a multipart body: the whole file is sent instead
+		ranges, err := ParseRange(header, info.Size())
+		if errors.Is(err, errRangeNotSatisfiable) {
+			res.HandleRangeNotSatisfiable(req, info.Size())
+			return
+		}
+		if err == nil && len(ranges) == 1 {
+			res.HandlePartialContent(ranges[0], info.Size())
+		}
+	}
+	if s.snapshot != nil {
+		// Serve the content from the snapshot, even if the file changed
+		res.FilePath = ""
+		res.Body = s.snapshot[url].data
+		age := time.Since(s.snapshotTime) / time.Second
+		res.Header["Age"] = strconv.FormatInt(int64(age), 10)
+	}
+	gzipped := false
+	if s.EnableGzip && res.StatusCode == statusOK && res.Header["Content-Encoding"] == "" &&
+		gzipCompressible(res.Header["Content-Type"]) && info.Size() <= s.maxGzipSize() {
+		addVary(res.Header, "Accept-Encoding")
+		if len(acceptedEncodings(req.Header["Accept-Encoding"], "gzip")) > 0 {
+			// A HEAD request is compressed too, only to send the same
+			// Content-Length (and Content-MD5) as a GET, as the
+			// compressed size can't be known otherwise
+			if !s.reserveBody(res, info.Size()) {
+				s.logf("Not compressing %v: MaxInFlightBodyBytes reached", url)
+			} else if body, err := s.gzipFile(url); err != nil {
+				s.logf("Failed to compress %v: %v", url, err)
+				s.releaseBody(res)
+			} else if !s.resizeBody(res, int64(len(body))) {
+				// A small file may grow when compressed
+				s.logf("Not compressing %v: MaxInFlightBodyBytes reached", url)
+				s.releaseBody(res)
+			} else {
+				res.FilePath = ""
+				res.Body = body
+				res.Header["Content-Length"] = strconv.Itoa(len(body))
+				res.Header["Content-Encoding"] = "gzip"
+				gzipped = true
+			}
+		}
+	}
+	if s.EmitContentMD5 && res.StatusCode == statusOK {
+		if gzipped {
+			// The digest is of the body as sent
+			sum := md5.Sum(res.Body)
+			res.Header["Content-MD5"] = base64.StdEncoding.EncodeToString(sum[:])
+		} else if sum, err := s.contentMD5(url, info); err != nil {
+			s.logf("Failed to compute Content-MD5 of %v: %v", url, err)
+		} else {
+			res.Header["Content-MD5"] = sum
+		}
+	}
+	if hints := s.PreloadHints[urlPath]; len(hints) > 0 && res.StatusCode == statusOK &&
+		strings.HasPrefix(res.Header["Content-Type"], "text/html") {
+		// Multiple Link headers are equivalent to one joined by commas
+		res.Header["Link"] = strings.Join(hints, ", ")
+	}
+}
+
+// precompressedExts lists the encodings of precompressed siblings,
+// from the most to the least preferred, with their file extensions.
+var precompressedExts = []struct {
+	encoding string
+	ext      string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// precompressedSibling returns the path and FileInfo of the best
+// precompressed sibling of the file at path, e.g. "index.html.gz" for
+// "index.html", acceptable according to the Accept-Encoding header,
+// and its encoding. It returns "" if there is none.
+func (s *Server) precompressedSibling(path, acceptEncoding string) (sibling, encoding string, info os.FileInfo) {
+	var supported []string
+	for _, p := range precompressedExts {
+		supported = append(supported, p.encoding)
+	}
+	for _, enc := range acceptedEncodings(acceptEncoding, supported...) {
+		for _, p := range precompressedExts {
+			if p.encoding != enc {
+				continue
+			}
+			if info, err := s.stat(path + p.ext); err == nil && !info.IsDir() {
+				return path + p.ext, enc, info
+			}
+		}
+	}
+	return "", "", nil
+}
+
+// addVary adds field to the Vary header in header.
+func addVary(header map[string]string, field string) {
+	v := header["Vary"]
+	for _, f := range strings.Split(v, ",") {
+		if strings.TrimSpace(f) == field {
+			return
+		}
+	}
+	if v != "" {
+		header["Vary"] = v + ", " + field
+	} else {
+		header["Vary"] = field
+	}
+}
+
+// byteOrderMarks lists the byte order marks starting text files,
+// with their charset.
+var byteOrderMarks = []struct {
+	bom     string
+	charset string
+}{
+	{"\xef\xbb\xbf", "utf-8"},
+	{"\xff\xfe", "utf-16le"},
+	{"\xfe\xff", "utf-16be"},
+}
+
+// bomCharset returns the charset given by the byte order mark of the
+// file at path, or "" if it has none. info is the result of stat'ing
+// the file. The charset is cached until the file is modified.
+func (s *Server) bomCharset(path string, info os.FileInfo) string {
+	s.charsetMu.Lock()
+	entry, ok := s.charsetCache[path]
+	s.charsetMu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.charset
+	}
+
+	f, err := s.open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	buf := make([]byte, 3)
+	n, _ := io.ReadFull(f, buf)
+	charset := ""
+	for _, m := range byteOrderMarks {
+		if strings.HasPrefix(string(buf[:n]), m.bom) {
+			charset = m.charset
+			break
+		}
+	}
+
+	s.charsetMu.Lock()
+	if s.charsetCache == nil {
+		s.charsetCache = make(map[string]charsetEntry)
+	}
+	s.charsetCache[path] = charsetEntry{modTime: info.ModTime(), charset: charset}
+	s.charsetMu.Unlock()
+	return charset
+}
+
+// gzipTypes are the MIME types compressed with EnableGzip.
+var gzipTypes = map[string]bool{
+	"text/html":              true,
+	"text/plain":             true,
+	"text/css":               true,
+	"text/javascript":        true,
+	"application/javascript": true,
+}
+
+// gzipCompressible reports whether bodies of the given Content-Type
+// are worth compressing. Already compressed types, e.g. images, are not.
+func gzipCompressible(contentType string) bool {
+	mediaType := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return gzipTypes[mediaType]
+}
+
+// reserveBody accounts for a body of up to n bytes built in memory for
+// res, until res is written. It returns false if that would exceed
+// MaxInFlightBodyBytes.
+func (s *Server) reserveBody(res *Response, n int64) bool {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	if s.MaxInFlightBodyBytes > 0 && s.inFlightBodyBytes+n > s.MaxInFlightBodyBytes {
+		return false
+	}
+	s.inFlightBodyBytes += n
+	res.inFlightBytes += n
+	return true
+}
+
+// resizeBody sets the bytes accounted for res to n, the actual size of
+// its body. It returns false if that would exceed MaxInFlightBodyBytes.
+func (s *Server) resizeBody(res *Response, n int64) bool {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	total := s.inFlightBodyBytes - res.inFlightBytes + n
+	if s.MaxInFlightBodyBytes > 0 && n > res.inFlightBytes && total > s.MaxInFlightBodyBytes {
+		return false
+	}
+	s.inFlightBodyBytes = total
+	res.inFlightBytes = n
+	return true
+}
+
+// releaseBody stops accounting for the body of res.
+func (s *Server) releaseBody(res *Response) {
+	s.inFlightMu.Lock()
+	defer s.inFlightMu.Unlock()
+	s.inFlightBodyBytes -= res.inFlightBytes
+	res.inFlightBytes = 0
+}
+
+// gzipFile returns the content of the file at path compressed with gzip.
+func (s *Server) gzipFile(path string) ([]byte, error) {
+	f, err := s.open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.Copy(zw, f); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// languageVariant returns the path of the best language variant of the
+// file at path for the given Accept-Language header, and its language.
+// The variant of "dir/index.html" in language "fr" is "dir/index.fr.html".
+// It returns "" if no variant exists.
+func (s *Server) languageVariant(path, acceptLanguage string) (variant, lang string) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	exists := func(l string) bool {
+		info, err := s.stat(base + "." + l + ext)
+		return err == nil && !info.IsDir()
+	}
+
+	for _, l := range parseAcceptLanguage(acceptLanguage) {
+		if exists(l) {
+			return base + "." + l + ext, l
+		}
+		// Also try the primary language, e.g. "en" for "en-us"
+		if i := strings.Index(l, "-"); i > 0 && exists(l[:i]) {
+			return base + "." + l[:i] + ext, l[:i]
+		}
+	}
+	if l := strings.ToLower(s.DefaultLanguage); validLanguageTag(l) && exists(l) {
+		return base + "." + l + ext, l
+	}
+	return "", ""
+}
+
+// parseAcceptLanguage returns the lowercased language tags of an
+// Accept-Language header, from the most to the least preferred.
+// Tags with a q-value of 0, the "*" wildcard, and malformed tags
+// are left out.
+func parseAcceptLanguage(header string) []string {
+	langs := []string{}
+	for _, v := range parseQValues(header) {
+		if v.q > 0 && validLanguageTag(v.value) {
+			langs = append(langs, v.value)
+		}
+	}
+	return langs
+}
+
+// acceptedEncodings returns the encodings among supported that are
+// acceptable according to the Accept-Encoding header, from the most to
+// the least preferred. Ties are broken by the order of supported.
+func acceptedEncodings(header string, supported ...string) []string {
+	qs := make(map[string]float64)
+	for _, v := range parseQValues(header) {
+		qs[v.value] = v.q
+	}
+	var accepted []qValue
+	for _, enc := range supported {
+		q, ok := qs[enc]
+		if !ok {
+			q = qs["*"]
+		}
+		if q > 0 {
+			accepted = append(accepted, qValue{enc, q})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].q > accepted[j].q
+	})
+
+	encodings := make([]string, len(accepted))
+	for i, v := range accepted {
+		encodings[i] = v.value
+	}
+	return encodings
+}
+
+// qValue is an element of a header list weighted with q-values,
+// such as Accept-Language or Accept-Encoding.
+type qValue struct {
+	value string
+	q     float64
+}
+
+// parseQValues parses a list of q-value weighted elements, e.g.
+// "fr;q=0.9, en;q=0.8", returning the lowercased elements from the
+// highest to the lowest q-value. Elements keep their order on ties.
+// Malformed q-values are treated as 0.
+func parseQValues(header string) []qValue {
+	var values []qValue
+	for _, field := range strings.Split(header, ",") {
+		params := strings.Split(field, ";")
+		value := strings.ToLower(strings.TrimSpace(params[0]))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				var err error
+				if q, err = strconv.ParseFloat(param[2:], 64); err != nil {
+					q = 0
+				}
+			}
+		}
+		values = append(values, qValue{value, q})
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].q > values[j].q
+	})
+	return values
+}
+
+// validLanguageTag reports whether tag looks like a language tag,
+// e.g. "en" or "en-us". This also keeps tags from altering the
+// directory of the variant looked up.
+func validLanguageTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// fixedEncoding returns the longest FixedEncodings suffix matching path,
+// and its encoding. The encoding is "" if no suffix matches.
+func (s *Server) fixedEncoding(path string) (suffix, encoding string) {
+	for sfx, enc := range s.FixedEncodings {
+		if strings.HasSuffix(path, sfx) && len(sfx) > len(suffix) {
+			suffix, encoding = sfx, enc
+		}
+	}
+	return suffix, encoding
 }
 
-// ListenAndServe listens on the TCP network address s.Addr and then
-// handles requests on incoming connections.
-func (s *Server) ListenAndServe() error {
-	// Hint: call HandleConnection
-	if err := s.ValidateServerSetup(); err != nil {
-		return fmt.Errorf("server is not setup correctly %v", err)
+// contentMD5 returns the base64 encoded MD5 digest of the file at path,
+// reusing the cached value if the file hasn't been modified since.
+func (s *Server) contentMD5(path string, info os.FileInfo) (string, error) {
+	s.md5Mu.Lock()
+	entry, ok := s.md5Cache[path]
+	s.md5Mu.Unlock()
+	if ok && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
 	}
 
-	// server should now start to listen on the configured address
-	ln, err := net.Listen("tcp", s.Addr)
+	f, err := s.open(path)
 	if err != nil {
-		return err
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
 	}
+	sum := base64.StdEncoding.EncodeToString(h.Sum(nil))
 
-	// making sure the listener is closed when we exit
-	defer func() {
-		err = ln.Close()
-		if err != nil {
-			fmt.Println("error in closing listener", err)
-		}
-	}()
+	s.md5Mu.Lock()
+	if s.md5Cache == nil {
+		s.md5Cache = make(map[string]md5Entry)
+	}
+	s.md5Cache[path] = md5Entry{modTime: info.ModTime(), sum: sum}
+	s.md5Mu.Unlock()
+	return sum, nil
+}
 
-	// accept connections forever
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			continue
-		}
-		fmt.Println("accepted connection", conn.RemoteAddr())
-		go s.HandleConnection(conn)
+func (s *Server) readTimeout() time.Duration {
+	if s.ReadTimeout == 0 {
+		return defaultReadTimeout
 	}
+	return s.ReadTimeout
 }
 
-func (s *Server) ValidateServerSetup() error {
-	// Validating the doc root of the server
-	directory, err := os.Stat(s.DocRoot)
+func (s *Server) maxURLLength() int {
+	if s.MaxURLLength == 0 {
+		return defaultMaxURLLength
+	}
+	return s.MaxURLLength
+}
 
-	if os.IsNotExist(err) {
-		return err
+func (s *Server) maxHeaderBytes() int {
+	if s.MaxHeaderBytes == 0 {
+		return defaultMaxHeaderBytes
 	}
+	return s.MaxHeaderBytes
+}
 
-	if !directory.IsDir() {
-		return errors.New("DocRoot not a directory")
+func (s *Server) maxPathSegments() int {
+	if s.MaxPathSegments == 0 {
+		return defaultMaxPathSegments
 	}
+	return s.MaxPathSegments
+}
 
-	return nil
+func (s *Server) maxGzipSize() int64 {
+	if s.MaxGzipSize == 0 {
+		return defaultMaxGzipSize
+	}
+	return s.MaxGzipSize
 }
 
-// HandleConnection reads requests from the accepted conn and handles them.
-func (s *Server) HandleConnection(conn net.Conn) {
-	br := bufio.NewReader(conn)
-	for {
-		// Set timeout
-		if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			log.Printf("Failed to set timeout for connection %v", conn)
-			_ = conn.Close()
-			return
+// pathSegments returns the number of non-empty segments of the URL path.
+func pathSegments(url string) int {
+	n := 0
+	for _, segment := range strings.Split(url, "/") {
+		if segment != "" {
+			n++
 		}
+	}
+	return n
+}
 
-		// Read next request from the client
-		req, _, err := ReadRequest(br)
+func (s *Server) manifestPath() string {
+	if s.ManifestPath == "" {
+		return defaultManifestPath
+	}
+	return s.ManifestPath
+}
 
-		// Handle EOF
-		if errors.Is(err, io.EOF) {
-			log.Printf("Connection closed by %v", conn.RemoteAddr())
-			_ = conn.Close()
-			return
-		}
+// handleManifest prepares res to be a 200 OK response carrying the
+// JSON manifest of DocRoot, regenerating it once ManifestTTL expires.
+func (s *Server) handleManifest(req *Request, res *Response) {
+	ttl := s.ManifestTTL
+	if ttl == 0 {
+		ttl = defaultManifestTTL
+	}
 
-		// timeout in this application means we just close the connection
-		if err, ok := err.(net.Error); ok && err.Timeout() {
-			log.Printf("Connection to %v timed out", conn.RemoteAddr())
-			_ = conn.Close()
+	s.manifestMu.Lock()
+	body := s.manifestBody
+	if body == nil || time.Since(s.manifestTime) >= ttl {
+		var err error
+		if body, err = s.buildManifest(); err != nil {
+			s.manifestMu.Unlock()
+			s.logf("Failed to build manifest of %v: %v", s.DocRoot, err)
+			res.HandleInternalError(req)
 			return
 		}
+		s.manifestBody = body
+		s.manifestTime = time.Now()
+	}
+	s.manifestMu.Unlock()
 
-		// Handle the request which is not a GET and immediately close the connection and return
-		if err != nil {
-			log.Printf("Handle bad request for error: %v", err)
-			res := &Response{}
-			res.HandleBadRequest()
-			_ = res.Write(conn)
-			_ = conn.Close()
-			return
-		}
+	res.Proto = responseProto
+	res.StatusCode = statusOK
+	res.Body = body
 
-		res := s.HandleGoodRequest(req)
-		err = res.Write(conn)
-		if err != nil {
-			fmt.Println(err)
-		}
+	m := res.newHeader()
+	m["Content-Length"] = strconv.Itoa(len(body))
+	m["Content-Type"] = "application/json"
+	m["Date"] = FormatTime(time.Now())
+	if req.Close {
+		m["Connection"] = "close"
 	}
+	res.Header = m
 }
 
-// HandleGoodRequest handles the valid req and generates the corresponding res.
-func (s *Server) HandleGoodRequest(req *Request) (res *Response) {
-	// Hint: use the other methods below
-	res = &Response{}
-	root := s.DocRoot
-	url := req.URL
-	l := len(url)
-	if root == "" {
-		root = "testdata/"
-	}
-	if url == "/" {
-		url = "/index.html"
-	} else if string(url[l-1]) == "/" {
-		url += "index.html"
+// handleDefaultFavicon prepares res to serve DefaultFavicon.
+func (s *Server) handleDefaultFavicon(req *Request, res *Response) {
+	res.Proto = responseProto
+	res.StatusCode = statusOK
+	res.Body = s.DefaultFavicon
+
+	m := res.newHeader()
+	m["Content-Length"] = strconv.Itoa(len(s.DefaultFavicon))
+	m["Content-Type"] = "image/x-icon"
+	m["Cache-Control"] = faviconCacheControl
+	m["Date"] = FormatTime(time.Now())
+	if req.Close {
+		m["Connection"] = "close"
 	}
-	filePath := filepath.Join(root, url)
-	filePath = filepath.Clean(filePath)
+	res.Header = m
+}
 
-	url, err1 := filepath.Abs(filePath)
-	if err1 != nil {
-		res.HandleNotFound(req)
+// handleDirectoryListing prepares res to serve an HTML listing of the
+// directory at the absolute path dir, requested as requestPath.
+func (s *Server) handleDirectoryListing(req *Request, res *Response, requestPath, dir string, info os.FileInfo) {
+	entries, err := s.readDir(dir)
+	if err != nil {
+		s.logf("Failed to list %v: %v", dir, err)
+		res.HandleInternalError(req)
 		return
 	}
-	req.URL = url
 
-	directory, err2 := filepath.Abs(root)
-	if err2 != nil {
-		res.HandleNotFound(req)
-		return
+	var b strings.Builder
+	title := html.EscapeString("Index of " + requestPath)
+	fmt.Fprintf(&b, "<!DOCTYPE html>\n<html>\n<head><title>%v</title></head>\n<body>\n<h1>%v</h1>\n<ul>\n", title, title)
+	if requestPath != "/" {
+		b.WriteString("<li><a href=\"../\">../</a></li>\n")
 	}
-	if !strings.HasPrefix(url, directory) || !fileExists(url) || isValidDir(url) {
-		res.HandleNotFound(req)
-		return
+	for _, e := range entries {
+		name := e.name
+		if e.isDir {
+			name += "/"
+		}
+		// Links are relative to the directory, with the names escaped
+		href := (&url.URL{Path: name}).EscapedPath()
+		if strings.Contains(e.name, ":") {
+			// Keep a colon in the first segment from reading as a scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%v\">%v</a></li>\n", html.EscapeString(href), html.EscapeString(name))
 	}
+	b.WriteString("</ul>\n</body>\n</html>\n")
+	body := []byte(b.String())
 
-	res.HandleOK(req, url)
+	res.Proto = responseProto
+	res.StatusCode = statusOK
+	res.Body = body
 
-	return res
+	m := res.newHeader()
+	m["Content-Length"] = strconv.Itoa(len(body))
+	m["Content-Type"] = "text/html; charset=utf-8"
+	m["Date"] = FormatTime(time.Now())
+	m["Last-Modified"] = FormatTime(info.ModTime())
+	if req.Close {
+		m["Connection"] = "close"
+	}
+	res.Header = m
+}
+
+// dirEntry is an entry of a directory listing.
+type dirEntry struct {
+	name  string
+	isDir bool
+}
+
+// readDir returns the entries of the directory at the absolute path,
+// sorted by name, from the snapshot if there is one.
+func (s *Server) readDir(path string) ([]dirEntry, error) {
+	var entries []dirEntry
+	if s.snapshot == nil {
+		des, err := os.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		for _, de := range des {
+			entries = append(entries, dirEntry{de.Name(), de.IsDir()})
+		}
+		return entries, nil
+	}
+	for p, entry := range s.snapshot {
+		if p != path && filepath.Dir(p) == path {
+			entries = append(entries, dirEntry{filepath.Base(p), entry.info.IsDir()})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, nil
+}
+
+// buildManifest returns the JSON encoded list of the regular files
+// under DocRoot, from the snapshot if there is one.
+func (s *Server) buildManifest() ([]byte, error) {
+	root, err := s.docRoot()
+	if err != nil {
+		return nil, err
+	}
+	entries := []manifestEntry{}
+	add := func(path string, info os.FileInfo) error {
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, manifestEntry{
+			Path:    "/" + filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+		})
+		return nil
+	}
+
+	if s.snapshot != nil {
+		for path, entry := range s.snapshot {
+			if !entry.info.Mode().IsRegular() {
+				continue
+			}
+			if err := add(path, entry.info); err != nil {
+				return nil, err
+			}
+		}
+		// Sorted by path, as the snapshot has no order
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+		return json.Marshal(entries)
+	}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return add(path, info)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(entries)
 }
 
 // HandleOK prepares res to be a 200 OK response
 // ready to be written back to client.
-func (res *Response) HandleOK(req *Request, path string) {
+// info is the result of stat'ing the file at path.
+func (res *Response) HandleOK(req *Request, path string, info os.FileInfo) {
 	res.Proto = responseProto
 	res.StatusCode = statusOK
 	res.FilePath = path
 
-	m := make(map[string]string)
-	contentLength := getContentLength(path)
-	m["Content-Length"] = contentLength
+	m := res.newHeader()
+	m["Content-Length"] = strconv.FormatInt(info.Size(), 10)
 	m["Date"] = FormatTime(time.Now())
-	m["Last-Modified"] = getLastModifiedTime(path)
-	m["Content-Type"] = MIMETypeByExtension(filepath.Ext(path))
+	m["Last-Modified"] = FormatTime(info.ModTime())
+	m["Content-Type"] = contentType(filepath.Ext(path))
 	if req.Close {
 		m["Connection"] = "close"
 	}
 	res.Header = m
+}
 
-	if contentLength == "" {
-		res.StatusCode = statusMethodNotFound
-		res.FilePath = ""
+// HandlePartialContent turns res, a 200 OK response prepared by HandleOK,
+// into a 206 Partial Content response with only the range r of the file,
+// whose size is size.
+func (res *Response) HandlePartialContent(r HTTPRange, size int64) {
+	res.StatusCode = statusPartialContent
+	res.bodyRange = &r
+	res.Header["Content-Length"] = strconv.FormatInt(r.Length, 10)
+	res.Header["Content-Range"] = fmt.Sprintf("bytes %v-%v/%v", r.Start, r.Start+r.Length-1, size)
+}
+
+// HandleRangeNotSatisfiable prepares res to be a 416 Range Not Satisfiable
+// response ready to be written back to client, for a file whose size is size.
+func (res *Response) HandleRangeNotSatisfiable(req *Request, size int64) {
+	res.Proto = responseProto
+	res.StatusCode = statusRangeNotSatisfiable
+	res.FilePath = ""
+	res.Body = nil
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Content-Range"] = fmt.Sprintf("bytes */%v", size)
+	if req.Close {
+		m["Connection"] = "close"
+	}
+	res.Header = m
+}
+
+// HandleNotModified prepares res to be a 304 Not Modified response
+// ready to be written back to client, with no body.
+// info is the result of stat'ing the file not modified.
+func (res *Response) HandleNotModified(req *Request, info os.FileInfo) {
+	res.Proto = responseProto
+	res.StatusCode = statusNotModified
+	res.FilePath = ""
+	res.Body = nil
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Last-Modified"] = FormatTime(info.ModTime())
+	if req.Close {
+		m["Connection"] = "close"
+	}
+	res.Header = m
+}
+
+// HandleMovedPermanently prepares res to be a 301 Moved Permanently
+// response to location, ready to be written back to client.
+func (res *Response) HandleMovedPermanently(req *Request, location string) {
+	res.Proto = responseProto
+	res.StatusCode = statusMovedPermanently
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Location"] = location
+	if req.Close {
+		m["Connection"] = "close"
 	}
+	res.Header = m
+}
+
+// HandleFound prepares res to be a 302 Found response
+// to location, ready to be written back to client.
+func (res *Response) HandleFound(req *Request, location string) {
+	res.Proto = responseProto
+	res.StatusCode = statusFound
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Location"] = location
+	if req.Close {
+		m["Connection"] = "close"
+	}
+	res.Header = m
 }
 
 // HandleBadRequest prepares res to be a 400 Bad Request response
 // ready to be written back to client.
 func (res *Response) HandleBadRequest() {
+	res.Proto = responseProto
+	res.StatusCode = statusBadRequest
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Connection"] = "close"
+	res.Header = m
+	res.setDefaultBody(badRequestBody)
+}
+
+// HandleMethodNotAllowed prepares res to be a 405 Method Not Allowed
+// response ready to be written back to client, listing the supported
+// methods in the Allow header.
+func (res *Response) HandleMethodNotAllowed() {
 	res.Proto = responseProto
 	res.StatusCode = statusMethodNotAllowed
 
-	m := make(map[string]string)
+	m := res.newHeader()
 	m["Date"] = FormatTime(time.Now())
+	m["Allow"] = allowedMethods
 	m["Connection"] = "close"
 	res.Header = m
 }
 
-// HandleNotFound prepares res to be a 404 Not Found response
-// ready to be written back to client.
-func (res *Response) HandleNotFound(req *Request) {
+// HandleHeaderTooLarge prepares res to be a 431 Request Header Fields
+// Too Large response ready to be written back to client.
+func (res *Response) HandleHeaderTooLarge() {
 	res.Proto = responseProto
-	res.StatusCode = statusMethodNotFound
+	res.StatusCode = statusHeaderTooLarge
 
-	m := make(map[string]string)
+	m := res.newHeader()
 	m["Date"] = FormatTime(time.Now())
+	m["Connection"] = "close"
+	res.Header = m
+}
 
+// HandleOptions prepares res to be a 204 No Content response to an
+// OPTIONS request, listing the supported methods in the Allow header.
+func (res *Response) HandleOptions(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusNoContent
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Allow"] = allowedMethods
 	if req.Close {
 		m["Connection"] = "close"
 	}
+	res.Header = m
+}
+
+// HandleUnavailable prepares res to be a 503 Service Unavailable response
+// ready to be written back to client, with no body.
+func (res *Response) HandleUnavailable(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusUnavailable
 
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Retry-After"] = maintenanceRetryAfter
+	if req.Close {
+		m["Connection"] = "close"
+	}
 	res.Header = m
 }
 
-//get last modified time of the file
-func getLastModifiedTime(filename string) string {
-	file, err := os.Stat(filename)
-	if err != nil {
-		return ""
+// HandleInternalError prepares res to be a 500 Internal Server Error
+// response ready to be written back to client.
+func (res *Response) HandleInternalError(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusInternalError
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+
+	if req.Close {
+		m["Connection"] = "close"
 	}
-	mtime := file.ModTime()
-	return FormatTime(mtime)
+
+	res.Header = m
 }
 
-func getContentLength(filename string) string {
-	fmt.Println("File  ", filename)
-	file, err := os.Stat(filename)
-	if err != nil {
-		return ""
+// HandleForbidden prepares res to be a 403 Forbidden response
+// ready to be written back to client.
+func (res *Response) HandleForbidden(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusForbidden
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+
+	if req.Close {
+		m["Connection"] = "close"
 	}
-	return strconv.FormatInt(file.Size(), 10)
+
+	res.Header = m
 }
 
-func fileExists(filename string) bool {
-	info, err := os.Stat(filename)
-	if os.IsNotExist(err) {
-		return false
+// HandleRequestTimeout prepares res to be a 408 Request Timeout response
+// ready to be written back to client.
+func (res *Response) HandleRequestTimeout() {
+	res.Proto = responseProto
+	res.StatusCode = statusRequestTimeout
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+	m["Connection"] = "close"
+	res.Header = m
+}
+
+// HandleURITooLong prepares res to be a 414 URI Too Long response
+// ready to be written back to client.
+func (res *Response) HandleURITooLong(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusURITooLong
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+
+	if req.Close {
+		m["Connection"] = "close"
 	}
-	return !info.IsDir()
+
+	res.Header = m
 }
 
-func isValidDir(path string) bool {
-	fileInfo, err := os.Stat(path)
-	if err != nil {
-		return true
+// HandleNotFound prepares res to be a 404 Not Found response
+// ready to be written back to client.
+func (res *Response) HandleNotFound(req *Request) {
+	res.Proto = responseProto
+	res.StatusCode = statusMethodNotFound
+
+	m := res.newHeader()
+	m["Date"] = FormatTime(time.Now())
+
+	if req.Close {
+		m["Connection"] = "close"
 	}
-	if fileInfo.IsDir() && string(path[len(path)-1]) != "/" {
-		return true
+
+	res.Header = m
+	res.setDefaultBody(notFoundBody)
+}
+
+// setDefaultBody makes body, an HTML page, the body of res.
+func (res *Response) setDefaultBody(body []byte) {
+	res.FilePath = ""
+	res.Body = body
+	res.Header["Content-Length"] = strconv.Itoa(len(body))
+	res.Header["Content-Type"] = contentType(".html")
+}
+
+// textContentTypes overrides the system MIME types of common plain text
+// extensions, which vary between platforms, so that they are always
+// served with the UTF-8 charset.
+var textContentTypes = map[string]string{
+	".txt": "text/plain; charset=utf-8",
+	".csv": "text/plain; charset=utf-8",
+	".md":  "text/plain; charset=utf-8",
+	".log": "text/plain; charset=utf-8",
+}
+
+// contentType returns the Content-Type to serve for files with
+// the extension ext.
+func contentType(ext string) string {
+	if t, ok := textContentTypes[strings.ToLower(ext)]; ok {
+		return t
 	}
-	return false
+	return MIMETypeByExtension(ext)
 }
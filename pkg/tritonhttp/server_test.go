@@ -1,14 +1,35 @@
 package tritonhttp
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
 	contentTypeHTML = "text/html; charset=utf-8"
 	contentTypeJPG  = "image/jpeg"
 	contentTypePNG  = "image/png"
+	contentTypeText = "text/plain; charset=utf-8"
 )
 
 func normalizeTestdataPath(path string) (string, error) {
@@ -100,6 +121,27 @@ func TestHandleGoodRequest(t *testing.T) {
 			},
 			"index.html",
 		},
+		{
+			"OKText",
+			&Request{
+				Method: "GET",
+				URL:    "/utf8.txt",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+				Close:  false,
+			},
+			200,
+			[]string{
+				"Date",
+				"Last-Modified",
+			},
+			map[string]string{
+				"Content-Type":   contentTypeText,
+				"Content-Length": "18",
+			},
+			"utf8.txt",
+		},
 		{
 			"NotFoundBasic",
 			&Request{
@@ -161,3 +203,3774 @@ func TestHandleGoodRequest(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleTraversal(t *testing.T) {
+	var tests = []struct {
+		name            string
+		traversalStatus int
+		statusWant      int
+	}{
+		{"Default", 0, 404},
+		{"NotFound", 404, 404},
+		{"Forbidden", 403, 403},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:            ":0",
+				DocRoot:         "testdata",
+				TraversalStatus: tt.traversalStatus,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/../server.go",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if res.FilePath != "" {
+				t.Fatalf("file path got: %q, want: %q", res.FilePath, "")
+			}
+		})
+	}
+}
+
+func TestHandleMaintenanceMode(t *testing.T) {
+	page, err := os.ReadFile("testdata/maintenance.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:            ":0",
+		DocRoot:         "testdata",
+		MaintenancePage: "maintenance.html",
+	}
+	s.SetMaintenanceMode(true)
+	newReq := func() *Request {
+		return &Request{
+			Method: "GET",
+			URL:    "/index.html",
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+	}
+
+	res := s.HandleGoodRequest(newReq())
+	if res.StatusCode != 503 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 503)
+	}
+	for h, vWant := range map[string]string{
+		"Retry-After":    "120",
+		"Content-Type":   contentTypeHTML,
+		"Content-Length": strconv.Itoa(len(page)),
+	} {
+		if v := res.Header[h]; v != vWant {
+			t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+		}
+	}
+	if !bytes.Equal(res.Body, page) || res.FilePath != "" {
+		t.Fatalf("body got: %q, file path %q, want: %q", res.Body, res.FilePath, page)
+	}
+
+	s.SetMaintenanceMode(false)
+	res = s.HandleGoodRequest(newReq())
+	if res.StatusCode != 200 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+	}
+	if _, ok := res.Header["Retry-After"]; ok {
+		t.Fatalf("unexpected header %q", "Retry-After")
+	}
+}
+
+func TestHandleMaintenancePageOutsideDocRoot(t *testing.T) {
+	s := &Server{
+		Addr:            ":0",
+		DocRoot:         "testdata/subdir",
+		MaintenancePage: "../maintenance.html",
+		Logger:          log.New(io.Discard, "", 0),
+	}
+	s.SetMaintenanceMode(true)
+	res := s.HandleGoodRequest(&Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	})
+	if res.StatusCode != 503 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 503)
+	}
+	if res.Body != nil || res.FilePath != "" {
+		t.Fatalf("body got: %q, file path %q, want none", res.Body, res.FilePath)
+	}
+}
+
+// TestMaintenanceModeToggle switches maintenance mode while requests are
+// served, for the race detector to check.
+func TestMaintenanceModeToggle(t *testing.T) {
+	s := &Server{
+		Addr:            ":0",
+		DocRoot:         "testdata",
+		MaintenancePage: "maintenance.html",
+	}
+	stop := make(chan struct{})
+	toggled := make(chan struct{})
+	go func() {
+		defer close(toggled)
+		for on := true; ; on = !on {
+			select {
+			case <-stop:
+				return
+			default:
+				s.SetMaintenanceMode(on)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client, done := serveOnPipe(s)
+			br := bufio.NewReader(client)
+			for j := 0; j < 50; j++ {
+				if _, err := io.WriteString(client, "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+					t.Error(err)
+					break
+				}
+				header, err := readResponseHeader(br)
+				if err != nil {
+					t.Error(err)
+					break
+				}
+				status := strings.SplitN(header, "\r\n", 2)[0]
+				if status != "HTTP/1.1 200 OK" && status != "HTTP/1.1 503 Service Unavailable" {
+					t.Errorf("got: %q, want a 200 or 503", status)
+					break
+				}
+				m := regexp.MustCompile(`Content-Length: (\d+)\r\n`).FindStringSubmatch(header)
+				n, _ := strconv.Atoi(m[1])
+				if _, err := br.Discard(n); err != nil {
+					t.Error(err)
+					break
+				}
+			}
+			client.Close()
+			<-done
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-toggled
+}
+
+// bufferConn records the socket buffer sizes set on it.
+type bufferConn struct {
+	net.Conn
+	readBuffer  int
+	writeBuffer int
+}
+
+func (c *bufferConn) SetReadBuffer(bytes int) error {
+	c.readBuffer = bytes
+	return nil
+}
+
+func (c *bufferConn) SetWriteBuffer(bytes int) error {
+	c.writeBuffer = bytes
+	return nil
+}
+
+func TestSetSocketBuffers(t *testing.T) {
+	var tests = []struct {
+		name            string
+		readBuffer      int
+		writeBuffer     int
+		readBufferWant  int
+		writeBufferWant int
+	}{
+		{"Default", 0, 0, 0, 0},
+		{"ReadOnly", 1 << 16, 0, 1 << 16, 0},
+		{"Both", 1 << 16, 1 << 20, 1 << 16, 1 << 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:              ":0",
+				DocRoot:           "testdata",
+				ReadSocketBuffer:  tt.readBuffer,
+				WriteSocketBuffer: tt.writeBuffer,
+			}
+			conn := &bufferConn{}
+			if err := s.setSocketBuffers(conn); err != nil {
+				t.Fatal(err)
+			}
+			if conn.readBuffer != tt.readBufferWant {
+				t.Fatalf("read buffer got: %v, want: %v", conn.readBuffer, tt.readBufferWant)
+			}
+			if conn.writeBuffer != tt.writeBufferWant {
+				t.Fatalf("write buffer got: %v, want: %v", conn.writeBuffer, tt.writeBufferWant)
+			}
+		})
+	}
+}
+
+// serveOnPipe runs s.HandleConnection on one end of an in-memory
+// connection, and returns the other end for the client to use.
+// The returned channel is closed when HandleConnection returns.
+func serveOnPipe(s *Server) (net.Conn, <-chan struct{}) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		s.HandleConnection(server)
+		close(done)
+	}()
+	return client, done
+}
+
+func TestRawRequestHook(t *testing.T) {
+	const magic = "TRITON\n"
+	var tests = []struct {
+		name       string
+		prefix     string
+		statusWant string // "" means the connection is closed with no response
+	}{
+		{"Magic", magic, "HTTP/1.1 200 OK"},
+		{"NoMagic", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: "testdata",
+				RawRequestHook: func(br *bufio.Reader) error {
+					prefix, err := br.Peek(len(magic))
+					if err != nil {
+						return err
+					}
+					if string(prefix) != magic {
+						return errors.New("missing magic prefix")
+					}
+					_, err = br.Discard(len(magic))
+					return err
+				},
+			}
+			client, done := serveOnPipe(s)
+			defer client.Close()
+
+			go func() {
+				_, _ = io.WriteString(client, tt.prefix+"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			}()
+			line, err := ReadLine(bufio.NewReader(client))
+			if tt.statusWant == "" {
+				if err == nil {
+					t.Fatalf("got unexpected response: %q", line)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if line != tt.statusWant {
+				t.Fatalf("got: %q, want: %q", line, tt.statusWant)
+			}
+			client.Close()
+			<-done
+		})
+	}
+}
+
+func TestHandleConnectionEmptyURL(t *testing.T) {
+	for _, reqText := range []string{
+		"GET  HTTP/1.1\r\nHost: test\r\n\r\n",
+		"GET  HTTP/1.1\r\n\r\n",
+	} {
+		s := &Server{
+			Addr:    ":0",
+			DocRoot: "testdata",
+		}
+		client, done := serveOnPipe(s)
+
+		go func(reqText string) {
+			_, _ = io.WriteString(client, reqText)
+		}(reqText)
+		line, err := ReadLine(bufio.NewReader(client))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "HTTP/1.1 400 Bad Request"; line != want {
+			t.Fatalf("%q: got: %q, want: %q", reqText, line, want)
+		}
+		// The connection is closed after a 400, so HandleConnection returns
+		// instead of the goroutine crashing.
+		client.Close()
+		<-done
+	}
+}
+
+func TestHandleConnectionHeadersByStatus(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		HeadersByStatus: map[int]map[string]string{
+			404: {"cache-control": "no-store"},
+			400: {"X-Reason": "malformed"},
+		},
+	}
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /notexist.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"This is a bad request\r\n")
+	s.HandleConnection(conn)
+
+	got := conn.w.String()
+	want := []string{"HTTP/1.1 200 OK", "HTTP/1.1 404 Not Found", "HTTP/1.1 400 Bad Request"}
+	if lines := statusLines(got); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got: %q, want: %q", lines, want)
+	}
+	// Split the responses at their status lines
+	responses := regexp.MustCompile(`HTTP/1\.1 \d{3} `).Split(got, -1)[1:]
+	for i, tt := range []struct {
+		header   string
+		included bool
+	}{
+		{"Cache-Control: no-store\r\n", false},
+		{"Cache-Control: no-store\r\n", true},
+		{"X-Reason: malformed\r\n", true},
+	} {
+		if strings.Contains(responses[i], tt.header) != tt.included {
+			t.Fatalf("response %q contains %q: %v, want: %v", want[i], tt.header, !tt.included, tt.included)
+		}
+	}
+	if strings.Count(got, "Cache-Control") != 1 || strings.Count(got, "X-Reason") != 1 {
+		t.Fatalf("configured headers on the wrong responses: %q", got)
+	}
+}
+
+func TestHandleConnectionNULInHeader(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\nKey: a\x00b\r\n\r\n")
+	s.HandleConnection(conn)
+	want := []string{"HTTP/1.1 400 Bad Request"}
+	if got := statusLines(conn.w.String()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	if !conn.closed {
+		t.Fatalf("connection is not closed")
+	}
+}
+
+func TestHandleManifest(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "subdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "subdir", "a.txt"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		Addr:           ":0",
+		DocRoot:        root,
+		EnableManifest: true,
+		ManifestPath:   "/_files.json",
+		ManifestTTL:    time.Hour,
+	}
+	getManifest := func() map[string]int64 {
+		req := &Request{
+			Method: "GET",
+			URL:    "/_files.json",
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+		res := s.HandleGoodRequest(req)
+		if res.StatusCode != 200 {
+			t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+		}
+		if v := res.Header["Content-Type"]; v != "application/json" {
+			t.Fatalf("header %q value got: %q, want %q", "Content-Type", v, "application/json")
+		}
+		var entries []manifestEntry
+		if err := json.Unmarshal(res.Body, &entries); err != nil {
+			t.Fatal(err)
+		}
+		sizes := make(map[string]int64)
+		for _, e := range entries {
+			sizes[e.Path] = e.Size
+		}
+		return sizes
+	}
+
+	sizes := getManifest()
+	if len(sizes) != 2 || sizes["/index.html"] != 12 || sizes["/subdir/a.txt"] != 3 {
+		t.Fatalf("unexpected manifest: %v", sizes)
+	}
+
+	// A new file shows up only once the cached manifest expires
+	if err := os.WriteFile(filepath.Join(root, "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if sizes = getManifest(); len(sizes) != 2 {
+		t.Fatalf("expected cached manifest, got: %v", sizes)
+	}
+	s.ManifestTTL = time.Nanosecond
+	if sizes = getManifest(); len(sizes) != 3 || sizes["/new.txt"] != 3 {
+		t.Fatalf("expected refreshed manifest, got: %v", sizes)
+	}
+}
+
+func TestHandleManifestRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name      string
+		docRoot   string
+		snapshot  bool
+		pathsWant []string
+	}{
+		// The files written after the snapshot are not served, nor listed
+		{"Snapshot", root, true, []string{"/index.html"}},
+		{"NoSnapshot", root, false, []string{"/index.html", "/new.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:           ":0",
+				DocRoot:        tt.docRoot,
+				EnableManifest: true,
+			}
+			if tt.snapshot {
+				if err := s.takeSnapshot(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(root, "new.txt"), []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(filepath.Join(root, "new.txt"))
+
+			res := s.HandleGoodRequest(&Request{
+				Method: "GET",
+				URL:    "/manifest.json",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			})
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			var entries []manifestEntry
+			if err := json.Unmarshal(res.Body, &entries); err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, e := range entries {
+				paths = append(paths, e.Path)
+			}
+			if !reflect.DeepEqual(paths, tt.pathsWant) {
+				t.Fatalf("got: %q, want: %q", paths, tt.pathsWant)
+			}
+		})
+	}
+}
+
+func TestHandleManifestEmptyDocRoot(t *testing.T) {
+	s := &Server{
+		Addr:           ":0",
+		EnableManifest: true,
+	}
+	res := s.HandleGoodRequest(&Request{
+		Method: "GET",
+		URL:    "/manifest.json",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	})
+	if res.StatusCode != 200 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+	}
+	var entries []manifestEntry
+	if err := json.Unmarshal(res.Body, &entries); err != nil {
+		t.Fatal(err)
+	}
+	// The files listed are those served, from the default root
+	listed := make(map[string]bool)
+	for _, e := range entries {
+		listed[e.Path] = true
+	}
+	if !listed["/index.html"] || !listed["/subdir/index.html"] || listed["/server.go"] {
+		t.Fatalf("unexpected manifest: %v", listed)
+	}
+}
+
+func TestHandleManifestDisabled(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	req := &Request{
+		Method: "GET",
+		URL:    "/manifest.json",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	}
+	if res := s.HandleGoodRequest(req); res.StatusCode != 404 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 404)
+	}
+}
+
+func TestHandleContentMD5(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "index.html")
+	if err := os.WriteFile(path, []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, enabled := range []bool{false, true} {
+		s := &Server{
+			Addr:           ":0",
+			DocRoot:        root,
+			EmitContentMD5: enabled,
+		}
+		for _, content := range []string{"Hello World\n", "Changed\n"} {
+			if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Make sure the modification time changes between rewrites
+			mtime := time.Now().Add(time.Duration(len(content)) * time.Second)
+			if err := os.Chtimes(path, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			sum := md5.Sum([]byte(content))
+			want := base64.StdEncoding.EncodeToString(sum[:])
+			v, ok := res.Header["Content-MD5"]
+			if !enabled {
+				if ok {
+					t.Fatalf("unexpected header %q", "Content-MD5")
+				}
+				continue
+			}
+			if v != want {
+				t.Fatalf("header %q value got: %q, want %q", "Content-MD5", v, want)
+			}
+		}
+	}
+}
+
+// timeoutError is the net.Error returned by fakeConn once its input
+// is exhausted, as if the read deadline expired.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// fakeConn is a net.Conn that reads from a fixed input, times out once
+// the input is exhausted, and records everything written to it.
+type fakeConn struct {
+	net.Conn
+	r      io.Reader
+	w      bytes.Buffer
+	closed bool
+}
+
+func newFakeConn(input string) *fakeConn {
+	return &fakeConn{r: strings.NewReader(input)}
+}
+
+func (c *fakeConn) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	if errors.Is(err, io.EOF) {
+		return n, timeoutError{}
+	}
+	return n, err
+}
+
+func (c *fakeConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *fakeConn) Close() error                { c.closed = true; return nil }
+func (c *fakeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestHandleConnectionTimeout(t *testing.T) {
+	var tests = []struct {
+		name       string
+		reqText    string
+		statusWant []string
+	}{
+		{
+			"NoBytes",
+			"",
+			nil,
+		},
+		{
+			"PartialRequest",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\nConnec",
+			[]string{"HTTP/1.1 408 Request Timeout"},
+		},
+		{
+			"OKThenNoBytes",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n",
+			[]string{"HTTP/1.1 200 OK"},
+		},
+		{
+			"OKThenPartialRequest",
+			"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\nGET /index.html",
+			[]string{"HTTP/1.1 200 OK", "HTTP/1.1 408 Request Timeout"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: "testdata",
+			}
+			conn := newFakeConn(tt.reqText)
+			s.HandleConnection(conn)
+			if !conn.closed {
+				t.Fatalf("connection is not closed")
+			}
+			got := statusLines(conn.w.String())
+			if !reflect.DeepEqual(got, tt.statusWant) {
+				t.Fatalf("got: %q, want: %q", got, tt.statusWant)
+			}
+		})
+	}
+}
+
+// statusLines returns the status lines of the responses written in out.
+func statusLines(out string) []string {
+	var lines []string
+	for _, m := range statusLineRegexp.FindAllStringSubmatch(out, -1) {
+		lines = append(lines, m[1])
+	}
+	return lines
+}
+
+var statusLineRegexp = regexp.MustCompile(`(HTTP/1\.[01] \d{3} [A-Za-z ]+)\r\n`)
+
+func TestContentType(t *testing.T) {
+	var tests = []struct {
+		ext  string
+		want string
+	}{
+		{".txt", contentTypeText},
+		{".csv", contentTypeText},
+		{".md", contentTypeText},
+		{".log", contentTypeText},
+		{".TXT", contentTypeText},
+		{".html", contentTypeHTML},
+		{".png", contentTypePNG},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ext, func(t *testing.T) {
+			if got := contentType(tt.ext); got != tt.want {
+				t.Fatalf("got: %q, want: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandlePreloadHints(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		PreloadHints: map[string][]string{
+			"/index.html": {
+				"</style.css>; rel=preload; as=style",
+				"</app.js>; rel=preload; as=script",
+			},
+			"/fake.png": {
+				"</style.css>; rel=preload; as=style",
+			},
+		},
+	}
+	var tests = []struct {
+		name string
+		url  string
+		want string // "" means no Link header
+	}{
+		{
+			"Configured",
+			"/index.html",
+			"</style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script",
+		},
+		{
+			"DirectoryIndex",
+			"/",
+			"</style.css>; rel=preload; as=style, </app.js>; rel=preload; as=script",
+		},
+		{
+			"NotConfigured",
+			"/subdir/index.html",
+			"",
+		},
+		{
+			"NotHTML",
+			"/fake.png",
+			"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			if got := res.Header["Link"]; got != tt.want {
+				t.Fatalf("header %q value got: %q, want %q", "Link", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionAccessLog(t *testing.T) {
+	var accessLog bytes.Buffer
+	s := &Server{
+		Addr:      ":0",
+		DocRoot:   "testdata",
+		AccessLog: &accessLog,
+	}
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /notexist.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"HEAD /subdir/ HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /index.html HTTP/1.1\r\nHost: test\r\nRange: bytes=0-4\r\n\r\n")
+	s.HandleConnection(conn)
+
+	const timestamp = `\[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\]`
+	want := []string{
+		`^127\.0\.0\.1 - - ` + timestamp + ` "GET /index\.html HTTP/1\.1" 200 12$`,
+		`^127\.0\.0\.1 - - ` + timestamp + ` "GET /notexist\.html HTTP/1\.1" 404 49$`,
+		`^127\.0\.0\.1 - - ` + timestamp + ` "HEAD /subdir/ HTTP/1\.1" 200 -$`,
+		`^127\.0\.0\.1 - - ` + timestamp + ` "GET /index\.html HTTP/1\.1" 206 5$`,
+	}
+	lines := strings.Split(strings.TrimSuffix(accessLog.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %v lines, want: %v\n%v", len(lines), len(want), accessLog.String())
+	}
+	for i, line := range lines {
+		if !regexp.MustCompile(want[i]).MatchString(line) {
+			t.Fatalf("line %v got: %q, want match: %q", i, line, want[i])
+		}
+	}
+}
+
+func TestHandleConnectionAccessLogUnread(t *testing.T) {
+	var tests = []struct {
+		name     string
+		reqText  string
+		lineWant string
+	}{
+		{"BadRequest", "GARBAGE\r\n\r\n", `"-" 400 ` + strconv.Itoa(len(badRequestBody))},
+		{"SimpleRequest", "GET /index.html\r\n", `"-" 400 ` + strconv.Itoa(len(badRequestBody))},
+		{"MethodNotAllowed", "POST /index.html HTTP/1.1\r\nHost: test\r\n\r\n", `"-" 405 -`},
+		{"RequestTimeout", "GET /index.html HTTP/1.1\r\nHost: test\r\n", `"-" 408 -`},
+		{"URITooLong", "GET /" + strings.Repeat("a", 8300) + " HTTP/1.1\r\n\r\n", `"-" 414 -`},
+		{"HeaderTooLarge", "GET /index.html HTTP/1.1\r\n" + strings.Repeat("A: b\r\n", 10000) + "\r\n", `"-" 431 -`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var accessLog bytes.Buffer
+			s := &Server{
+				Addr:      ":0",
+				DocRoot:   "testdata",
+				AccessLog: &accessLog,
+				Logger:    log.New(io.Discard, "", 0),
+			}
+			s.HandleConnection(newFakeConn(tt.reqText))
+
+			want := `^127\.0\.0\.1 - - \[[^]]+\] ` + regexp.QuoteMeta(tt.lineWant) + "\n$"
+			if got := accessLog.String(); !regexp.MustCompile(want).MatchString(got) {
+				t.Fatalf("got: %q, want match: %q", got, want)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionLogRequestBodySize(t *testing.T) {
+	var accessLog bytes.Buffer
+	s := &Server{
+		Addr:               ":0",
+		DocRoot:            "testdata",
+		AccessLog:          &accessLog,
+		LogRequestBodySize: true,
+		Logger:             log.New(io.Discard, "", 0),
+	}
+	// A POST is rejected before its body is read, so it has no size
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: 11\r\n\r\nhello world" +
+		"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"POST /index.html HTTP/1.1\r\nHost: test\r\nContent-Length: 5\r\n\r\nhello")
+	s.HandleConnection(conn)
+
+	want := []string{
+		`"GET /index.html HTTP/1.1" 200 12 11`,
+		`"GET /index.html HTTP/1.1" 200 12 -`,
+		`"-" 405 - -`,
+	}
+	lines := strings.Split(strings.TrimSuffix(accessLog.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %v lines, want: %v\n%v", len(lines), len(want), accessLog.String())
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, "] "+want[i]) {
+			t.Fatalf("line %v got: %q, want suffix: %q", i, line, want[i])
+		}
+	}
+}
+
+func TestHandleConnectionCombinedLog(t *testing.T) {
+	var accessLog bytes.Buffer
+	s := &Server{
+		Addr:        ":0",
+		DocRoot:     "testdata",
+		AccessLog:   &accessLog,
+		CombinedLog: true,
+	}
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n" +
+		"Referer: http://example.com/from.html\r\nUser-Agent: curl/7.79.1\r\n\r\n" +
+		"GET /index.html HTTP/1.1\r\nHost: test\r\nUser-Agent: say \"hi\"\r\n\r\n")
+	s.HandleConnection(conn)
+
+	const timestamp = `\[\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}\]`
+	want := []string{
+		`^127\.0\.0\.1 - - ` + timestamp + ` "GET /index\.html HTTP/1\.1" 200 12 "http://example\.com/from\.html" "curl/7\.79\.1"$`,
+		`^127\.0\.0\.1 - - ` + timestamp + ` "GET /index\.html HTTP/1\.1" 200 12 - "say \\"hi\\""$`,
+	}
+	lines := strings.Split(strings.TrimSuffix(accessLog.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("got %v lines, want: %v\n%v", len(lines), len(want), accessLog.String())
+	}
+	for i, line := range lines {
+		if !regexp.MustCompile(want[i]).MatchString(line) {
+			t.Fatalf("line %v got: %q, want match: %q", i, line, want[i])
+		}
+	}
+}
+
+func TestHandleConnectionArtificialLatency(t *testing.T) {
+	const latency = 100 * time.Millisecond
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Debug=%v", debug), func(t *testing.T) {
+			s := &Server{
+				Addr:              ":0",
+				DocRoot:           "testdata",
+				Debug:             debug,
+				Logger:            log.New(io.Discard, "", 0),
+				ArtificialLatency: latency,
+			}
+			conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+				"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			start := time.Now()
+			s.HandleConnection(conn)
+			elapsed := time.Since(start)
+
+			if got := statusLines(conn.w.String()); len(got) != 2 {
+				t.Fatalf("got: %q, want 2 responses", got)
+			}
+			// Every response is delayed
+			if debug && elapsed < 2*latency {
+				t.Fatalf("responses took %v, want at least %v", elapsed, 2*latency)
+			}
+			if !debug && elapsed >= latency {
+				t.Fatalf("responses took %v, want no delay", elapsed)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionMixedLineEndings(t *testing.T) {
+	root := t.TempDir()
+	content := []byte("unix\nwindows\r\nold mac\rnone")
+	if err := os.WriteFile(filepath.Join(root, "mixed.txt"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: root,
+	}
+	conn := newFakeConn("GET /mixed.txt HTTP/1.1\r\nHost: test\r\n\r\n")
+	s.HandleConnection(conn)
+
+	// Files are served byte for byte, with no newline translation
+	got := conn.w.String()
+	if want := "Content-Length: " + strconv.Itoa(len(content)) + "\r\n"; !strings.Contains(got, want) {
+		t.Fatalf("response %q doesn't contain %q", got, want)
+	}
+	if !strings.HasSuffix(got, "\r\n\r\n"+string(content)) {
+		t.Fatalf("response %q doesn't end with the file content %q", got, content)
+	}
+}
+
+func TestHandleConnectionStatOnce(t *testing.T) {
+	for _, emitContentMD5 := range []bool{false, true} {
+		stats := 0
+		s := &Server{
+			Addr:           ":0",
+			DocRoot:        "testdata",
+			EmitContentMD5: emitContentMD5,
+			statFile: func(name string) (os.FileInfo, error) {
+				stats++
+				return os.Stat(name)
+			},
+		}
+		conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+		s.HandleConnection(conn)
+		if got := statusLines(conn.w.String()); !reflect.DeepEqual(got, []string{"HTTP/1.1 200 OK"}) {
+			t.Fatalf("got: %q, want: %q", got, []string{"HTTP/1.1 200 OK"})
+		}
+		if !strings.HasSuffix(conn.w.String(), "\r\n\r\nHello World\n") {
+			t.Fatalf("unexpected response: %q", conn.w.String())
+		}
+		if stats != 1 {
+			t.Fatalf("EmitContentMD5 %v: got %v stats, want: 1", emitContentMD5, stats)
+		}
+	}
+}
+
+func TestHandleFixedEncodings(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		FixedEncodings: map[string]string{
+			".br": "br",
+			".gz": "gzip",
+		},
+	}
+	var tests = []struct {
+		name             string
+		url              string
+		headerValuesWant map[string]string
+	}{
+		{
+			"Encoded",
+			"/app.js.br",
+			map[string]string{
+				"Content-Encoding": "br",
+				"Content-Type":     MIMETypeByExtension(".js"),
+				"Content-Length":   "10",
+			},
+		},
+		{
+			"NotEncoded",
+			"/index.html",
+			map[string]string{
+				"Content-Encoding": "",
+				"Content-Type":     contentTypeHTML,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			for h, vWant := range tt.headerValuesWant {
+				if v := res.Header[h]; v != vWant {
+					t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+				}
+			}
+		})
+	}
+}
+
+func TestServeClosedListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:    ln.Addr().String(),
+		DocRoot: "testdata",
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	// Make sure the server is accepting connections before closing
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	if err := ln.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("got: %v, want: nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Serve did not return after the listener was closed")
+	}
+}
+
+// failingListener fails every Accept until it is closed.
+type failingListener struct {
+	net.Listener
+	mu      sync.Mutex
+	accepts int
+	closed  bool
+}
+
+func (ln *failingListener) Accept() (net.Conn, error) {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.closed {
+		return nil, net.ErrClosed
+	}
+	ln.accepts++
+	return nil, errors.New("too many open files")
+}
+
+func (ln *failingListener) Close() error {
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	ln.closed = true
+	return nil
+}
+
+// shutdownListener accepts a single connection, shutting the server
+// down just before returning it, as if Shutdown raced the Accept.
+type shutdownListener struct {
+	net.Listener
+	conn     net.Conn
+	shutdown func()
+	once     sync.Once
+}
+
+func (ln *shutdownListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	ln.once.Do(func() {
+		ln.shutdown()
+		conn = ln.conn
+	})
+	if conn == nil {
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (ln *shutdownListener) Close() error {
+	return nil
+}
+
+func TestServeShutdownAfterAccept(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	ln := &shutdownListener{
+		conn: server,
+		shutdown: func() {
+			if err := s.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+		},
+	}
+	if err := s.Serve(ln); err != nil {
+		t.Fatalf("got: %v, want: nil", err)
+	}
+
+	// The connection accepted after Shutdown is closed, not served.
+	// Setting the deadline fails if it is closed already
+	_ = client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("got: %v, want: %v", err, io.EOF)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) != 0 {
+		t.Fatalf("tracked connections got: %v, want: %v", len(s.conns), 0)
+	}
+}
+
+func TestServeAcceptBackoff(t *testing.T) {
+	ln := &failingListener{}
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		Logger:  log.New(io.Discard, "", 0),
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	// The delays are 5, 10, 20, 40, 80ms... so only a few Accepts fit
+	time.Sleep(200 * time.Millisecond)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("got: %v, want: nil", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after the listener was closed")
+	}
+	ln.mu.Lock()
+	defer ln.mu.Unlock()
+	if ln.accepts > 10 {
+		t.Fatalf("got %v accepts, want at most 10", ln.accepts)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	// Find a free port for ListenAndServe
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	s := &Server{
+		Addr:    addr,
+		DocRoot: "testdata",
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ListenAndServe()
+	}()
+
+	var conn net.Conn
+	for i := 0; ; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := ReadLine(bufio.NewReader(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "HTTP/1.1 200 OK"; line != want {
+		t.Fatalf("got: %q, want: %q", line, want)
+	}
+	conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatalf("got: %v, want: nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("ListenAndServe did not return after Shutdown")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatalf("server still accepts connections after Shutdown")
+	}
+}
+
+func TestServeMaxConns(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:        ln.Addr().String(),
+		DocRoot:     "testdata",
+		ReadTimeout: time.Minute,
+		MaxConns:    2,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	// Keep-alive connections, which hold their slot until closed
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if _, err := io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		readers = append(readers, bufio.NewReader(conn))
+	}
+	for i := 0; i < 2; i++ {
+		if line, err := ReadLine(readers[i]); err != nil || line != "HTTP/1.1 200 OK" {
+			t.Fatalf("connection %v got: %q, %v, want: %q", i, line, err, "HTTP/1.1 200 OK")
+		}
+	}
+	if err := conns[2].SetReadDeadline(time.Now().Add(200 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := ReadLine(readers[2]); err == nil {
+		t.Fatalf("third connection served while two are open: %q", line)
+	}
+
+	// Closing a connection frees a slot for the third one
+	conns[0].Close()
+	if err := conns[2].SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := ReadLine(readers[2]); err != nil || line != "HTTP/1.1 200 OK" {
+		t.Fatalf("third connection got: %q, %v, want: %q", line, err, "HTTP/1.1 200 OK")
+	}
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+	ln.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:        ln.Addr().String(),
+		DocRoot:     "testdata",
+		ReadTimeout: time.Minute,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	// A connection in the middle of a request, which the server keeps
+	// waiting on
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\nGET /index.html HTTP/1.1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	if _, err := ReadLine(br); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("got: %v, want: nil", err)
+	}
+	// The lingering connection is closed by the server
+	if err := conn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(br); err != nil {
+		t.Fatalf("connection is not closed: %v", err)
+	}
+}
+
+func TestShutdownKeepAlive(t *testing.T) {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:        ln.Addr().String(),
+		DocRoot:     "testdata",
+		ReadTimeout: time.Minute,
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(ln)
+	}()
+
+	// A keep-alive client, sending requests until told to stop
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(10 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	connectionc := make(chan string, 1)
+	go func() {
+		br := bufio.NewReader(conn)
+		for {
+			if _, err := io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+				connectionc <- err.Error()
+				return
+			}
+			header, err := readResponseHeader(br)
+			if err == nil {
+				_, err = io.CopyN(io.Discard, br, int64(len("Hello World\n")))
+			}
+			if err != nil {
+				connectionc <- err.Error()
+				return
+			}
+			if strings.Contains(header, "\r\nConnection: close\r\n") {
+				connectionc <- "close"
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("got: %v, want: nil", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("Shutdown took %v", d)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("got: %v, want: nil", err)
+	}
+	// The client is either told to close, or finds the idle connection
+	// closed before sending its next request
+	select {
+	case got := <-connectionc:
+		if got != "close" && !strings.Contains(got, "EOF") && !strings.Contains(got, "reset") && !strings.Contains(got, "broken pipe") {
+			t.Fatalf("client got: %q, want: %q or the connection closed", got, "close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client still served after Shutdown")
+	}
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServeLogger(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Debug=%v", debug), func(t *testing.T) {
+			// Capture anything written to the standard output
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout := os.Stdout
+			os.Stdout = w
+			defer func() { os.Stdout = stdout }()
+			stdoutc := make(chan string)
+			go func() {
+				b, _ := io.ReadAll(r)
+				stdoutc <- string(b)
+			}()
+
+			ln, err := net.Listen("tcp", "localhost:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var logs syncBuffer
+			s := &Server{
+				Addr:        ln.Addr().String(),
+				DocRoot:     "testdata",
+				ReadTimeout: 100 * time.Millisecond,
+				Logger:      log.New(&logs, "", 0),
+				Debug:       debug,
+			}
+			errc := make(chan error, 1)
+			go func() {
+				errc <- s.Serve(ln)
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.WriteString(conn, "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			// The server closes the idle connection after ReadTimeout
+			out, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			if want := []string{"HTTP/1.1 200 OK"}; !reflect.DeepEqual(statusLines(string(out)), want) {
+				t.Fatalf("got: %q, want: %q", statusLines(string(out)), want)
+			}
+			ln.Close()
+			if err := <-errc; err != nil {
+				t.Fatal(err)
+			}
+
+			w.Close()
+			if got := <-stdoutc; got != "" {
+				t.Fatalf("got unexpected output on stdout: %q", got)
+			}
+			if !strings.Contains(logs.String(), "timed out") {
+				t.Fatalf("logs %q don't contain %q", logs.String(), "timed out")
+			}
+			if strings.Contains(logs.String(), "Accepted connection") != debug {
+				t.Fatalf("logs %q contain debug messages: %v, want: %v", logs.String(), !debug, debug)
+			}
+		})
+	}
+}
+
+func TestHandleLanguageVariants(t *testing.T) {
+	var tests = []struct {
+		name            string
+		defaultLanguage string
+		acceptLanguage  string
+		filePathWant    string // relative to doc root
+		languageWant    string
+	}{
+		{"Match", "en", "fr", "lang/index.fr.html", "fr"},
+		{"PrimaryLanguage", "", "fr-CA", "lang/index.fr.html", "fr"},
+		{"QValues", "", "de;q=0.9, en;q=0.5, fr;q=0.8", "lang/index.fr.html", "fr"},
+		{"QValuesZero", "", "fr;q=0, en;q=0.1", "lang/index.en.html", "en"},
+		{"Fallback", "en", "de, es;q=0.8", "lang/index.en.html", "en"},
+		{"NoHeader", "en", "", "lang/index.en.html", "en"},
+		{"NoFallback", "", "de", "lang/index.html", ""},
+		{"MissingFallback", "de", "es", "lang/index.html", ""},
+		{"Traversal", "", "../fake", "lang/index.html", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:             ":0",
+				DocRoot:          "testdata",
+				LanguageVariants: true,
+				DefaultLanguage:  tt.defaultLanguage,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/lang/",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			if tt.acceptLanguage != "" {
+				req.Header["Accept-Language"] = tt.acceptLanguage
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			filePath, err := normalizeTestdataPath(res.FilePath)
+			if err != nil {
+				t.Fatalf("invalid file path: %q", res.FilePath)
+			}
+			if filePath != tt.filePathWant {
+				t.Fatalf("file path (relative to testdata/) got: %q, want: %q", filePath, tt.filePathWant)
+			}
+			if v := res.Header["Content-Language"]; v != tt.languageWant {
+				t.Fatalf("header %q value got: %q, want %q", "Content-Language", v, tt.languageWant)
+			}
+			if v := res.Header["Vary"]; v != "Accept-Language" {
+				t.Fatalf("header %q value got: %q, want %q", "Vary", v, "Accept-Language")
+			}
+		})
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	var tests = []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"en", []string{"en"}},
+		{"fr-CH, fr;q=0.9, en;q=0.8, de;q=0.7, *;q=0.5", []string{"fr-ch", "fr", "en", "de"}},
+		{"de;q=0.7, en, fr;q=0.9", []string{"en", "fr", "de"}},
+		{"en;q=0.5, fr;q=0.5", []string{"en", "fr"}},
+		{"en;q=0, fr;q=bad, de", []string{"de"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := parseAcceptLanguage(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got: %q, want: %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleIfModifiedSince(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "index.html")
+	if err := os.WriteFile(path, []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2022, 3, 18, 4, 0, 7, 500, time.UTC)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name       string
+		ims        string
+		statusWant int
+	}{
+		{"Same", FormatTime(mtime), 304},
+		{"Later", FormatTime(mtime.Add(time.Hour)), 304},
+		{"Earlier", FormatTime(mtime.Add(-time.Second)), 200},
+		{"Absent", "", 200},
+		{"Unparseable", "yesterday", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: root,
+			}
+			header := map[string]string{}
+			if tt.ims != "" {
+				header["If-Modified-Since"] = tt.ims
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: header,
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if v := res.Header["Last-Modified"]; v != FormatTime(mtime) {
+				t.Fatalf("header %q value got: %q, want %q", "Last-Modified", v, FormatTime(mtime))
+			}
+			var buffer bytes.Buffer
+			if err := res.WriteBody(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			if tt.statusWant == 304 {
+				if v, ok := res.Header["Content-Length"]; ok {
+					t.Fatalf("header %q value got: %q, want none", "Content-Length", v)
+				}
+				if buffer.Len() != 0 {
+					t.Fatalf("got unexpected body: %q", buffer.String())
+				}
+			} else if buffer.String() != "Hello World\n" {
+				t.Fatalf("body got: %q, want: %q", buffer.String(), "Hello World\n")
+			}
+		})
+	}
+}
+
+func TestHandleRange(t *testing.T) {
+	var tests = []struct {
+		name              string
+		rangeHeader       string
+		statusWant        int
+		contentRangeWant  string
+		contentLengthWant string
+		bodyWant          string
+	}{
+		{"Range", "bytes=0-4", 206, "bytes 0-4/12", "5", "Hello"},
+		{"OpenEnded", "bytes=6-", 206, "bytes 6-11/12", "6", "World\n"},
+		{"Suffix", "bytes=-6", 206, "bytes 6-11/12", "6", "World\n"},
+		{"EndPastFile", "bytes=6-100", 206, "bytes 6-11/12", "6", "World\n"},
+		{"NotSatisfiable", "bytes=12-", 416, "bytes */12", "", ""},
+		{"Invalid", "bytes=x-y", 200, "", "12", "Hello World\n"},
+		{"Multiple", "bytes=0-1,3-4", 200, "", "12", "Hello World\n"},
+		{"None", "", 200, "", "12", "Hello World\n"},
+	}
+
+	for _, snapshot := range []bool{false, true} {
+		s := &Server{
+			Addr:    ":0",
+			DocRoot: "testdata",
+		}
+		if snapshot {
+			if err := s.takeSnapshot(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%v/Snapshot=%v", tt.name, snapshot), func(t *testing.T) {
+				header := map[string]string{}
+				if tt.rangeHeader != "" {
+					header["Range"] = tt.rangeHeader
+				}
+				req := &Request{
+					Method: "GET",
+					URL:    "/index.html",
+					Proto:  "HTTP/1.1",
+					Header: header,
+					Host:   "test",
+				}
+				res := s.HandleGoodRequest(req)
+				if res.StatusCode != tt.statusWant {
+					t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+				}
+				if v := res.Header["Content-Range"]; v != tt.contentRangeWant {
+					t.Fatalf("header %q value got: %q, want %q", "Content-Range", v, tt.contentRangeWant)
+				}
+				if v := res.Header["Content-Length"]; v != tt.contentLengthWant {
+					t.Fatalf("header %q value got: %q, want %q", "Content-Length", v, tt.contentLengthWant)
+				}
+				var buffer bytes.Buffer
+				if err := res.WriteBody(&buffer); err != nil {
+					t.Fatal(err)
+				}
+				if got := buffer.String(); got != tt.bodyWant {
+					t.Fatalf("body got: %q, want: %q", got, tt.bodyWant)
+				}
+			})
+		}
+	}
+}
+
+func TestHandleCanonicalizeIndex(t *testing.T) {
+	var tests = []struct {
+		name         string
+		canonicalize bool
+		url          string
+		statusWant   int
+		locationWant string
+	}{
+		{"Root", true, "/index.html", 301, "/"},
+		{"Subdir", true, "/subdir/index.html", 301, "/subdir/"},
+		{"Directory", true, "/subdir/", 200, ""},
+		{"OtherFile", true, "/fake.png", 200, ""},
+		{"Disabled", false, "/index.html", 200, ""},
+		{"Missing", true, "/nope/index.html", 404, ""},
+		{"DoubleSlash", true, "//subdir/index.html", 301, "/subdir/"},
+		{"OtherHost", true, "//evil.com/index.html", 404, ""},
+		{"Encoded", true, "/subdir/%69ndex.html", 301, "/subdir/"},
+		{"DotSegments", true, "/lang/../subdir/index.html", 301, "/subdir/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:              ":0",
+				DocRoot:           "testdata",
+				CanonicalizeIndex: tt.canonicalize,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if v := res.Header["Location"]; v != tt.locationWant {
+				t.Fatalf("header %q value got: %q, want %q", "Location", v, tt.locationWant)
+			}
+			if tt.statusWant == 301 && res.FilePath != "" {
+				t.Fatalf("file path got: %q, want: %q", res.FilePath, "")
+			}
+		})
+	}
+}
+
+func TestHandleErrorBody(t *testing.T) {
+	var tests = []struct {
+		name     string
+		handle   func(res *Response)
+		bodyWant string
+	}{
+		{
+			"BadRequest",
+			func(res *Response) { res.HandleBadRequest() },
+			"<html><body><h1>400 Bad Request</h1></body></html>\n",
+		},
+		{
+			"NotFound",
+			func(res *Response) { res.HandleNotFound(&Request{Method: "GET"}) },
+			"<html><body><h1>404 Not Found</h1></body></html>\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &Response{}
+			tt.handle(res)
+			for h, vWant := range map[string]string{
+				"Content-Type":   contentTypeHTML,
+				"Content-Length": strconv.Itoa(len(tt.bodyWant)),
+			} {
+				if v := res.Header[h]; v != vWant {
+					t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+				}
+			}
+			var buffer bytes.Buffer
+			if err := res.Write(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			if got := buffer.String(); !strings.HasSuffix(got, "\r\n\r\n"+tt.bodyWant) {
+				t.Fatalf("response %q doesn't end with body %q", got, tt.bodyWant)
+			}
+		})
+	}
+}
+
+func TestHandleNotFoundFile(t *testing.T) {
+	root := t.TempDir()
+	page := []byte("<h1>Nothing here</h1>\n")
+	if err := os.WriteFile(filepath.Join(root, "404.html"), page, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name         string
+		notFoundFile string
+		url          string
+		bodyWant     []byte
+	}{
+		{"Missing", "404.html", "/missing.html", page},
+		{"Traversal", "404.html", "/../missing.html", page},
+		// The default body is sent when there is no page
+		{"PageMissing", "nopage.html", "/missing.html", notFoundBody},
+		{"PageOutsideDocRoot", "../404.html", "/missing.html", notFoundBody},
+		{"Unset", "", "/missing.html", notFoundBody},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:         ":0",
+				DocRoot:      root,
+				NotFoundFile: tt.notFoundFile,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 404 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 404)
+			}
+			var buffer bytes.Buffer
+			if err := res.Write(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			got := buffer.String()
+			if !strings.HasPrefix(got, "HTTP/1.1 404 Not Found\r\n") {
+				t.Fatalf("response %q is not a 404", got)
+			}
+			if !strings.HasSuffix(got, "\r\n\r\n"+string(tt.bodyWant)) {
+				t.Fatalf("response %q doesn't end with body %q", got, tt.bodyWant)
+			}
+			for h, vWant := range map[string]string{
+				"Content-Type":   contentTypeHTML,
+				"Content-Length": strconv.Itoa(len(tt.bodyWant)),
+			} {
+				if v := res.Header[h]; v != vWant {
+					t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleNotFoundFileCached(t *testing.T) {
+	root := t.TempDir()
+	page := filepath.Join(root, "404.html")
+	if err := os.WriteFile(page, []byte("<h1>Nothing here</h1>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reads := 0
+	s := &Server{
+		Addr:         ":0",
+		DocRoot:      root,
+		NotFoundFile: "404.html",
+		openFile: func(name string) (io.ReadCloser, error) {
+			if name == page {
+				reads++
+			}
+			return os.Open(name)
+		},
+	}
+	get := func() string {
+		req := &Request{
+			Method: "GET",
+			URL:    "/missing.html",
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+		res := s.HandleGoodRequest(req)
+		if res.StatusCode != 404 {
+			t.Fatalf("status code got: %v, want: %v", res.StatusCode, 404)
+		}
+		return string(res.Body)
+	}
+
+	for i := 0; i < 3; i++ {
+		if body := get(); body != "<h1>Nothing here</h1>\n" {
+			t.Fatalf("body got: %q, want: %q", body, "<h1>Nothing here</h1>\n")
+		}
+	}
+	if reads != 1 {
+		t.Fatalf("page reads got: %v, want: %v", reads, 1)
+	}
+
+	// A modified page is read again
+	if err := os.WriteFile(page, []byte("<h1>Gone</h1>\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(page, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if body := get(); body != "<h1>Gone</h1>\n" {
+		t.Fatalf("body got: %q, want: %q", body, "<h1>Gone</h1>\n")
+	}
+	if reads != 2 {
+		t.Fatalf("page reads got: %v, want: %v", reads, 2)
+	}
+}
+
+func TestHandleNotFoundRedirect(t *testing.T) {
+	var tests = []struct {
+		name         string
+		redirect     string
+		param        string
+		url          string
+		statusWant   int
+		locationWant string
+	}{
+		{"Redirect", "/search", "", "/missing.html", 302, "/search"},
+		{"WithParam", "/search", "q", "/missing page.html", 302, "/search?q=%2Fmissing+page.html"},
+		{"WithExistingQuery", "/search?lang=en", "q", "/a/b.html", 302, "/search?lang=en&q=%2Fa%2Fb.html"},
+		{"Directory", "/search", "q", "/subdir", 301, "/subdir/"},
+		{"Found", "/search", "q", "/index.html", 200, ""},
+		{"Traversal", "/search", "q", "/../server.go", 404, ""},
+		{"Disabled", "", "", "/missing.html", 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:                  ":0",
+				DocRoot:               "testdata",
+				NotFoundRedirect:      tt.redirect,
+				NotFoundRedirectParam: tt.param,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if v := res.Header["Location"]; v != tt.locationWant {
+				t.Fatalf("header %q value got: %q, want %q", "Location", v, tt.locationWant)
+			}
+			if tt.statusWant == 302 && res.FilePath != "" {
+				t.Fatalf("file path got: %q, want: %q", res.FilePath, "")
+			}
+		})
+	}
+}
+
+// fakeTracer records the spans started and ended.
+type fakeTracer struct {
+	started []string // URLs of the requests
+	ended   []int    // status codes
+}
+
+func (tr *fakeTracer) StartSpan(req *Request) (SpanContext, func(status int)) {
+	tr.started = append(tr.started, req.URL)
+	sc := SpanContext{TraceID: "trace", SpanID: strconv.Itoa(len(tr.started))}
+	return sc, func(status int) {
+		tr.ended = append(tr.ended, status)
+	}
+}
+
+func TestHandleTracer(t *testing.T) {
+	tr := &fakeTracer{}
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		Tracer:  tr,
+	}
+	for _, url := range []string{"/index.html", "/notexist.html"} {
+		req := &Request{
+			Method: "GET",
+			URL:    url,
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+		s.HandleGoodRequest(req)
+	}
+	if want := []string{"/index.html", "/notexist.html"}; !reflect.DeepEqual(tr.started, want) {
+		t.Fatalf("started spans got: %v, want: %v", tr.started, want)
+	}
+	if want := []int{200, 404}; !reflect.DeepEqual(tr.ended, want) {
+		t.Fatalf("ended spans got: %v, want: %v", tr.ended, want)
+	}
+}
+
+// userTracer attaches the user of every request as a value, like an
+// authentication middleware would.
+type userTracer struct{}
+
+func (userTracer) StartSpan(req *Request) (SpanContext, func(status int)) {
+	req.SetValue("user", req.Header["Authorization"])
+	return SpanContext{}, func(status int) {}
+}
+
+func TestHandleRequestValues(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+		Tracer:  userTracer{},
+	}
+	req := &Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{"Authorization": "alice"},
+		Host:   "test",
+	}
+	res := s.HandleGoodRequest(req)
+	// The value set before the request is handled is still attached to it
+	if v := res.Request.GetValue("user"); v != "alice" {
+		t.Fatalf("got: %v, want: %v", v, "alice")
+	}
+}
+
+func TestHandleConnectionHTTP09(t *testing.T) {
+	var tests = []struct {
+		name          string
+		supportHTTP09 bool
+		reqText       string
+		resWant       string
+	}{
+		{
+			"Supported",
+			true,
+			"GET /index.html\r\n",
+			"Hello World\n",
+		},
+		{
+			"SupportedNotFound",
+			true,
+			"GET /notexist.html\r\n",
+			"",
+		},
+		{
+			"Unsupported",
+			false,
+			"GET /index.html\r\n",
+			"HTTP/1.1 400 Bad Request\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:          ":0",
+				DocRoot:       "testdata",
+				SupportHTTP09: tt.supportHTTP09,
+			}
+			// The pipelined request must not be read after a simple request
+			conn := newFakeConn(tt.reqText + "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			s.HandleConnection(conn)
+			if !conn.closed {
+				t.Fatalf("connection is not closed")
+			}
+			got := conn.w.String()
+			if tt.supportHTTP09 {
+				if got != tt.resWant {
+					t.Fatalf("got: %q, want: %q", got, tt.resWant)
+				}
+			} else if !strings.HasPrefix(got, tt.resWant) {
+				t.Fatalf("got: %q, want prefix: %q", got, tt.resWant)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionMethodNotAllowed(t *testing.T) {
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		t.Run(method, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: "testdata",
+			}
+			conn := newFakeConn(method + " /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			s.HandleConnection(conn)
+			if !conn.closed {
+				t.Fatalf("connection is not closed")
+			}
+			got := conn.w.String()
+			want := []string{"HTTP/1.1 405 Method Not Allowed"}
+			if lines := statusLines(got); !reflect.DeepEqual(lines, want) {
+				t.Fatalf("got: %q, want: %q", lines, want)
+			}
+			for _, h := range []string{"Allow: GET, HEAD, OPTIONS\r\n", "Connection: close\r\n"} {
+				if !strings.Contains(got, h) {
+					t.Fatalf("response %q doesn't contain %q", got, h)
+				}
+			}
+		})
+	}
+}
+
+func TestHandleConnectionHeadersTooLargeRequest(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	client, done := serveOnPipe(s)
+	defer client.Close()
+
+	go func() {
+		// The server stops reading long before the end
+		_, _ = io.WriteString(client, "GET /index.html HTTP/1.1\r\nHost: test\r\n"+
+			strings.Repeat("A: b\r\n", 10000)+"\r\n")
+	}()
+	if err := client.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HTTP/1.1 431 Request Header Fields Too Large"}
+	if lines := statusLines(string(out)); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got: %q, want: %q", lines, want)
+	}
+	<-done
+}
+
+func TestHandleConnectionURITooLong(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	client, done := serveOnPipe(s)
+	defer client.Close()
+
+	go func() {
+		// Longer than the default MaxURLLength, and than MaxHeaderBytes
+		_, _ = io.WriteString(client, "GET /"+strings.Repeat("a", 8300)+" HTTP/1.1\r\nHost: test\r\n\r\n")
+	}()
+	if err := client.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"HTTP/1.1 414 URI Too Long"}
+	if lines := statusLines(string(out)); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got: %q, want: %q", lines, want)
+	}
+	if !strings.Contains(string(out), "Connection: close\r\n") {
+		t.Fatalf("got: %q, want: %q header", out, "Connection: close")
+	}
+	<-done
+}
+
+func TestHandleConnectionOptions(t *testing.T) {
+	for _, url := range []string{"/", "*", "/notexist.html"} {
+		t.Run(url, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: "testdata",
+			}
+			conn := newFakeConn("OPTIONS " + url + " HTTP/1.1\r\nHost: test\r\n\r\n")
+			s.HandleConnection(conn)
+
+			got := conn.w.String()
+			want := []string{"HTTP/1.1 204 No Content"}
+			if lines := statusLines(got); !reflect.DeepEqual(lines, want) {
+				t.Fatalf("got: %q, want: %q", lines, want)
+			}
+			if h := "Allow: GET, HEAD, OPTIONS\r\n"; !strings.Contains(got, h) {
+				t.Fatalf("response %q doesn't contain %q", got, h)
+			}
+			// No body, and no Content-Length, follows the headers of a 204
+			if strings.Contains(got, "Content-Length") || !strings.HasSuffix(got, "GMT\r\n\r\n") {
+				t.Fatalf("response %q has a body", got)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionHead(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	conn := newFakeConn("HEAD /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"HEAD /notexist.html HTTP/1.1\r\nHost: test\r\n\r\n")
+	s.HandleConnection(conn)
+
+	got := conn.w.String()
+	want := []string{"HTTP/1.1 200 OK", "HTTP/1.1 404 Not Found"}
+	if lines := statusLines(got); !reflect.DeepEqual(lines, want) {
+		t.Fatalf("got: %q, want: %q", lines, want)
+	}
+	// Content-Length is the size of the file, but no body follows the headers
+	if !strings.Contains(got, "Content-Length: 12\r\n") {
+		t.Fatalf("response %q doesn't contain %q", got, "Content-Length: 12\r\n")
+	}
+	if !strings.Contains(got, "\r\n\r\nHTTP/1.1 404") || !strings.HasSuffix(got, "\r\n\r\n") {
+		t.Fatalf("response %q has a body", got)
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	info, err := os.Stat("testdata/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+		Close:  true,
+	}
+	var buffer bytes.Buffer
+	status, bodyBytes, _, err := s.writeResponse(&buffer, req, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != 200 || bodyBytes != 12 {
+		t.Fatalf("got: %v, %v bytes, want: %v, %v bytes", status, bodyBytes, 200, 12)
+	}
+
+	// The Date is the only part of the response not known in advance
+	got := dateHeaderRegexp.ReplaceAllString(buffer.String(), "Date: <date>\r\n")
+	want := "HTTP/1.1 200 OK\r\n" +
+		"Connection: close\r\n" +
+		"Content-Length: 12\r\n" +
+		"Content-Type: " + contentTypeHTML + "\r\n" +
+		"Date: <date>\r\n" +
+		"Last-Modified: " + FormatTime(info.ModTime()) + "\r\n" +
+		"\r\n" +
+		"Hello World\n"
+	if got != want {
+		t.Fatalf("\ngot: %q\nwant: %q", got, want)
+	}
+}
+
+var dateHeaderRegexp = regexp.MustCompile(`Date: [^\r]*\r\n`)
+
+func TestHandleConnectionClose(t *testing.T) {
+	var tests = []struct {
+		name    string
+		reqText string
+	}{
+		{"Requested", "GET /index.html HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"},
+		{"RequestedNotFound", "GET /notexist.html HTTP/1.1\r\nHost: test\r\nConnection: close\r\n\r\n"},
+		{"ByServer", "GET /" + strings.Repeat("a/", 200) + " HTTP/1.1\r\nHost: test\r\n\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:        ":0",
+				DocRoot:     "testdata",
+				ReadTimeout: time.Minute,
+			}
+			client, done := serveOnPipe(s)
+			defer client.Close()
+
+			go func() {
+				_, _ = io.WriteString(client, tt.reqText)
+			}()
+			// The server closes the connection right after the response,
+			// instead of waiting for another request until ReadTimeout
+			if err := client.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			out, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatalf("connection is not closed: %v", err)
+			}
+			if lines := statusLines(string(out)); len(lines) != 1 {
+				t.Fatalf("got: %q, want one response", lines)
+			}
+			if !strings.Contains(string(out), "Connection: close\r\n") {
+				t.Fatalf("response %q doesn't contain %q", out, "Connection: close\r\n")
+			}
+			<-done
+		})
+	}
+}
+
+func TestHandleConnectionMaxLifetime(t *testing.T) {
+	var tests = []struct {
+		name      string
+		last      string // sent after the keep-alive request, then the client stalls
+		pipelined bool   // last is sent along with the keep-alive request
+		linesWant []string
+	}{
+		{"Idle", "", false, nil},
+		{"PartialRequest", "GET /index.html HTTP/1.1\r\nHost: test\r\n", false, []string{"HTTP/1.1 408 Request Timeout"}},
+		{"Pipelined", "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n", true, []string{"HTTP/1.1 200 OK"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:            ":0",
+				DocRoot:         "testdata",
+				ReadTimeout:     time.Minute,
+				MaxConnLifetime: 300 * time.Millisecond,
+			}
+			if tt.pipelined {
+				// The pipelined request is only read once the lifetime elapsed
+				s.Debug = true
+				s.ArtificialLatency = 350 * time.Millisecond
+			}
+			client, done := serveOnPipe(s)
+			defer client.Close()
+			if err := client.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+				t.Fatal(err)
+			}
+			br := bufio.NewReader(client)
+			start := time.Now()
+
+			// A keep-alive request is served before the lifetime elapses
+			first := "GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n"
+			if tt.pipelined {
+				first += tt.last
+			}
+			if _, err := io.WriteString(client, first); err != nil {
+				t.Fatal(err)
+			}
+			res, err := readResponseHeader(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(res, "HTTP/1.1 200 OK\r\n") || strings.Contains(res, "Connection: close") {
+				t.Fatalf("got: %q, want a keep-alive 200", res)
+			}
+			if _, err := br.Discard(12); err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.pipelined && tt.last != "" {
+				if _, err := io.WriteString(client, tt.last); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// The connection is closed even though ReadTimeout is far away
+			out, err := io.ReadAll(br)
+			if err != nil {
+				t.Fatalf("connection is not closed: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed < s.MaxConnLifetime {
+				t.Fatalf("connection closed after %v, want at least %v", elapsed, s.MaxConnLifetime)
+			}
+			if lines := statusLines(string(out)); !reflect.DeepEqual(lines, tt.linesWant) {
+				t.Fatalf("got: %q, want: %q", lines, tt.linesWant)
+			}
+			if len(tt.linesWant) > 0 && !strings.Contains(string(out), "Connection: close\r\n") {
+				t.Fatalf("response %q doesn't contain %q", out, "Connection: close\r\n")
+			}
+			<-done
+		})
+	}
+}
+
+// readResponseHeader reads the status line and headers of a response
+// from br, up to the empty line.
+func readResponseHeader(br *bufio.Reader) (string, error) {
+	var header string
+	for {
+		line, err := ReadLine(br)
+		if err != nil {
+			return header, err
+		}
+		header += line + "\r\n"
+		if line == "" {
+			return header, nil
+		}
+	}
+}
+
+func TestHandleConnectionCloseAfterLargeResponse(t *testing.T) {
+	var tests = []struct {
+		name      string
+		threshold int64
+		linesWant []string
+		closeWant bool
+	}{
+		{"Large", 11, []string{"HTTP/1.1 200 OK"}, true},
+		{"AtThreshold", 12, []string{"HTTP/1.1 200 OK", "HTTP/1.1 200 OK"}, false},
+		{"Disabled", 0, []string{"HTTP/1.1 200 OK", "HTTP/1.1 200 OK"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:                    ":0",
+				DocRoot:                 "testdata",
+				CloseAfterLargeResponse: tt.threshold,
+			}
+			// index.html is 12 bytes
+			conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+				"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			s.HandleConnection(conn)
+			got := conn.w.String()
+			if lines := statusLines(got); !reflect.DeepEqual(lines, tt.linesWant) {
+				t.Fatalf("got: %q, want: %q", lines, tt.linesWant)
+			}
+			if strings.Contains(got, "Connection: close\r\n") != tt.closeWant {
+				t.Fatalf("response %q has Connection: close: %v, want: %v", got, !tt.closeWant, tt.closeWant)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionHTTP10(t *testing.T) {
+	var tests = []struct {
+		name           string
+		connection     string
+		linesWant      []string
+		connectionWant string
+	}{
+		{
+			"Default",
+			"",
+			[]string{"HTTP/1.1 200 OK"},
+			"close",
+		},
+		{
+			"KeepAlive",
+			"Connection: keep-alive\r\n",
+			[]string{"HTTP/1.1 200 OK", "HTTP/1.1 200 OK"},
+			"keep-alive",
+		},
+		{
+			"Close",
+			"Connection: close\r\n",
+			[]string{"HTTP/1.1 200 OK"},
+			"close",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: "testdata",
+			}
+			// The second request is only answered if the connection is kept alive
+			conn := newFakeConn("GET /index.html HTTP/1.0\r\nHost: test\r\n" + tt.connection + "\r\n" +
+				"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+			s.HandleConnection(conn)
+			if !conn.closed {
+				t.Fatalf("connection is not closed")
+			}
+			got := conn.w.String()
+			if lines := statusLines(got); !reflect.DeepEqual(lines, tt.linesWant) {
+				t.Fatalf("got: %q, want: %q", lines, tt.linesWant)
+			}
+			if h := "Connection: " + tt.connectionWant + "\r\n"; !strings.Contains(got, h) {
+				t.Fatalf("response %q doesn't contain %q", got, h)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionHeadersTooLarge(t *testing.T) {
+	s := &Server{
+		Addr:               ":0",
+		DocRoot:            "testdata",
+		MaxResponseHeaders: 2,
+	}
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n")
+	s.HandleConnection(conn)
+	if !conn.closed {
+		t.Fatalf("connection is not closed")
+	}
+	want := []string{"HTTP/1.1 500 Internal Server Error"}
+	if got := statusLines(conn.w.String()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+}
+
+func TestHandleSnapshot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:              ":0",
+		DocRoot:           root,
+		SnapshotAtStartup: true,
+		EmitContentMD5:    true,
+	}
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes to the doc root after the snapshot are not visible
+	if err := os.Remove(filepath.Join(root, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "new.html"), []byte("New\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := newFakeConn("GET /index.html HTTP/1.1\r\nHost: test\r\n\r\n" +
+		"GET /new.html HTTP/1.1\r\nHost: test\r\n\r\n")
+	s.HandleConnection(conn)
+	want := []string{"HTTP/1.1 200 OK", "HTTP/1.1 404 Not Found"}
+	if got := statusLines(conn.w.String()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	sum := md5.Sum([]byte("Hello World\n"))
+	for _, s := range []string{
+		"Content-Length: 12\r\n",
+		"Content-MD5: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n",
+		"\r\n\r\nHello World\nHTTP/1.1 404",
+	} {
+		if !strings.Contains(conn.w.String(), s) {
+			t.Fatalf("response %q doesn't contain %q", conn.w.String(), s)
+		}
+	}
+}
+
+func TestHandleSnapshotAge(t *testing.T) {
+	s := &Server{
+		Addr:              ":0",
+		DocRoot:           "testdata",
+		SnapshotAtStartup: true,
+	}
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the snapshot was taken a while ago
+	s.snapshotTime = s.snapshotTime.Add(-90 * time.Second)
+
+	newRequest := func() *Request {
+		return &Request{
+			Method: "GET",
+			URL:    "/index.html",
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{"Host": "test"},
+		}
+	}
+	res := s.HandleGoodRequest(newRequest())
+	if res.StatusCode != 200 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+	}
+	if got := res.Header["Age"]; got != "90" {
+		t.Fatalf("header %q value got: %q, want %q", "Age", got, "90")
+	}
+
+	// Files served from disk are fresh
+	s = &Server{
+		Addr:    ":0",
+		DocRoot: "testdata",
+	}
+	res = s.HandleGoodRequest(newRequest())
+	if res.StatusCode != 200 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+	}
+	if got, ok := res.Header["Age"]; ok {
+		t.Fatalf("header %q value got: %q, want none", "Age", got)
+	}
+}
+
+func TestHandleSnapshotHeadRange(t *testing.T) {
+	s := &Server{
+		Addr:              ":0",
+		DocRoot:           "testdata",
+		SnapshotAtStartup: true,
+	}
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	// The file is served from the snapshot, without reading the disk
+	accesses := 0
+	s.statFile = func(name string) (os.FileInfo, error) {
+		accesses++
+		return os.Stat(name)
+	}
+	s.openFile = func(name string) (io.ReadCloser, error) {
+		accesses++
+		return os.Open(name)
+	}
+
+	conn := newFakeConn("HEAD /index.html HTTP/1.1\r\nHost: test\r\nRange: bytes=0-4\r\n\r\n")
+	s.HandleConnection(conn)
+	out := conn.w.String()
+	if got, want := statusLines(out), []string{"HTTP/1.1 206 Partial Content"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	for _, h := range []string{"Content-Length: 5\r\n", "Content-Range: bytes 0-4/12\r\n"} {
+		if !strings.Contains(out, h) {
+			t.Fatalf("response %q doesn't contain %q", out, h)
+		}
+	}
+	if !strings.HasSuffix(out, "\r\n\r\n") {
+		t.Fatalf("response %q has a body", out)
+	}
+	if accesses != 0 {
+		t.Fatalf("disk accesses got: %v, want: %v", accesses, 0)
+	}
+}
+
+func TestHandleURLLimits(t *testing.T) {
+	var tests = []struct {
+		name            string
+		maxURLLength    int
+		maxPathSegments int
+		url             string
+		statusWant      int
+	}{
+		{"WithinLimits", 11, 1, "/index.html", 200},
+		{"TooLong", 10, 0, "/index.html", 414},
+		{"TooLongDefault", 0, 0, "/" + strings.Repeat("a", 8192), 414},
+		{"TooManySegments", 0, 1, "/subdir/index.html", 400},
+		{"TooManySegmentsDefault", 0, 0, strings.Repeat("/a", 129), 400},
+		{"TooManySegmentsEncoded", 0, 1, "/subdir%2Findex.html", 400},
+		{"SegmentsWithinLimit", 0, 2, "/subdir/index.html", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:            ":0",
+				DocRoot:         "testdata",
+				MaxURLLength:    tt.maxURLLength,
+				MaxPathSegments: tt.maxPathSegments,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+		})
+	}
+}
+
+func TestHandleRequireUserAgent(t *testing.T) {
+	var tests = []struct {
+		name             string
+		requireUserAgent bool
+		header           map[string]string
+		statusWant       int
+	}{
+		{"Missing", true, map[string]string{}, 400},
+		{"Empty", true, map[string]string{"User-Agent": ""}, 400},
+		{"Present", true, map[string]string{"User-Agent": "curl/7.79.1"}, 200},
+		{"NotRequired", false, map[string]string{}, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:             ":0",
+				DocRoot:          "testdata",
+				RequireUserAgent: tt.requireUserAgent,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/index.html",
+				Proto:  "HTTP/1.1",
+				Header: tt.header,
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+		})
+	}
+}
+
+func TestHandleDirectoryRedirect(t *testing.T) {
+	root, err := filepath.Abs("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name         string
+		url          string
+		statusWant   int
+		locationWant string
+	}{
+		{"Directory", "/subdir", 301, "/subdir/"},
+		{"OtherDirectory", "/precompressed", 301, "/precompressed/"},
+		{"TrailingSlash", "/subdir/", 200, ""},
+		{"File", "/index.html", 200, ""},
+		{"Missing", "/nodir", 404, ""},
+		{"DoubleSlash", "//subdir", 301, "/subdir/"},
+		{"DotSegments", "/lang/../subdir", 301, "/subdir/"},
+		{"Encoded", "/%73ubdir", 301, "/subdir/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: root,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			// The Location is the requested path, not a path under DocRoot
+			if v := res.Header["Location"]; v != tt.locationWant {
+				t.Fatalf("header %q value got: %q, want %q", "Location", v, tt.locationWant)
+			}
+		})
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	sep := string(filepath.Separator)
+	www := filepath.Join(sep, "srv", "www")
+	var tests = []struct {
+		path string
+		dir  string
+		want bool
+	}{
+		{www, www, true},
+		{filepath.Join(www, "index.html"), www, true},
+		{filepath.Join(www, "a", "b.html"), www, true},
+		{filepath.Join(sep, "srv", "www-secret", "file"), www, false},
+		{filepath.Join(sep, "srv", "www2"), www, false},
+		{filepath.Join(sep, "srv"), www, false},
+		{filepath.Join(sep, "srv", "www", "file"), sep, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path+" in "+tt.dir, func(t *testing.T) {
+			if got := insideDir(tt.path, tt.dir); got != tt.want {
+				t.Fatalf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsPathSafe(t *testing.T) {
+	www := filepath.Join(string(filepath.Separator), "srv", "www")
+	var tests = []struct {
+		requested string
+		want      bool
+	}{
+		{"/", true},
+		{"/index.html", true},
+		{"/subdir/../index.html", true},
+		{"/a/b/../../index.html", true},
+		{"/..foo/index.html", true},
+		{"/..", false},
+		{"/../", false},
+		{"/../etc/passwd", false},
+		{"/a/../../etc/passwd", false},
+		{"/../www-secret/file", false},
+		{"/./../etc/passwd", false},
+		{"/..\\etc\\passwd", false},
+		{"/index.html\x00.png", false},
+		{"index.html", false},
+		{"", false},
+		// Encoded payloads, decoded the way handleGoodRequest does
+		{"/%2e%2e/etc/passwd", false},
+		{"/%2E%2E%2Fetc%2Fpasswd", false},
+		{"/..%2f..%2fetc%2fpasswd", false},
+		{"/a/%2e%2e/%2e%2e/etc/passwd", false},
+		{"/%2e%2e%5cetc%5cpasswd", false},
+		{"/index.html%00.png", false},
+		{"/subdir/%2e%2e/index.html", true},
+		{"/%2e%2e%2e/index.html", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.requested, func(t *testing.T) {
+			requested, err := url.PathUnescape(tt.requested)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := isPathSafe(www, requested); got != tt.want {
+				t.Fatalf("got: %v, want: %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleSiblingDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for _, d := range []string{"www", "www-secret"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, d, "file.html"), []byte(d), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: filepath.Join(dir, "www"),
+	}
+	for _, tt := range []struct {
+		url        string
+		statusWant int
+	}{
+		{"/file.html", 200},
+		// Resolves to a path starting with DocRoot, but outside of it
+		{"/../www-secret/file.html", 404},
+	} {
+		req := &Request{
+			Method: "GET",
+			URL:    tt.url,
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+		res := s.HandleGoodRequest(req)
+		if res.StatusCode != tt.statusWant {
+			t.Fatalf("%v: status code got: %v, want: %v", tt.url, res.StatusCode, tt.statusWant)
+		}
+	}
+}
+
+func TestHandleSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	for _, d := range []string{root, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(root, "index.html"):    "index",
+		filepath.Join(outside, "secret.txt"): "secret",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"secret.txt":  filepath.Join("..", "outside", "secret.txt"),
+		"outside":     outside,
+		"inside.html": "index.html",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+
+	var tests = []struct {
+		name           string
+		followSymlinks bool
+		url            string
+		statusWant     int
+	}{
+		{"FileOutside", false, "/secret.txt", 404},
+		{"DirectoryOutside", false, "/outside/secret.txt", 404},
+		{"Inside", false, "/inside.html", 200},
+		{"FollowFileOutside", true, "/secret.txt", 200},
+		{"FollowDirectoryOutside", true, "/outside/secret.txt", 200},
+		{"FollowInside", true, "/inside.html", 200},
+		{"ListingOutside", false, "/outside/", 404},
+		{"FollowListingOutside", true, "/outside/", 200},
+	}
+
+	for _, tt := range tests {
+		for _, snapshot := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%v/Snapshot=%v", tt.name, snapshot), func(t *testing.T) {
+				s := &Server{
+					Addr:              ":0",
+					DocRoot:           root,
+					FollowSymlinks:    tt.followSymlinks,
+					SnapshotAtStartup: snapshot,
+					DirectoryListing:  true,
+				}
+				if snapshot {
+					if err := s.takeSnapshot(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				req := &Request{
+					Method: "GET",
+					URL:    tt.url,
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{},
+					Host:   "test",
+				}
+				res := s.HandleGoodRequest(req)
+				if res.StatusCode != tt.statusWant {
+					t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+				}
+			})
+		}
+	}
+}
+
+func TestHandleSnapshotSymlinkedDocRoot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("Hello World\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(root, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	s := &Server{
+		Addr:              ":0",
+		DocRoot:           link,
+		SnapshotAtStartup: true,
+	}
+	if err := s.takeSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{
+		Method: "GET",
+		URL:    "/index.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{},
+		Host:   "test",
+	}
+	res := s.HandleGoodRequest(req)
+	if res.StatusCode != 200 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+	}
+	if got := string(res.Body); got != "Hello World\n" {
+		t.Fatalf("body got: %q, want: %q", got, "Hello World\n")
+	}
+}
+
+func TestHandlePercentEncoded(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "my dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"my file.txt", "a+b.txt", filepath.Join("my dir", "index.html")} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		name         string
+		url          string
+		statusWant   int
+		filePathWant string // relative to doc root
+		locationWant string
+	}{
+		{"Space", "/my%20file.txt", 200, "my file.txt", ""},
+		{"EncodedSlash", "/my%20dir%2Findex.html", 200, filepath.Join("my dir", "index.html"), ""},
+		{"Plus", "/a+b.txt", 200, "a+b.txt", ""},
+		{"EncodedPlus", "/a%2Bb.txt", 200, "a+b.txt", ""},
+		{"PlusIsNotSpace", "/my+file.txt", 404, "", ""},
+		{"DirectoryRedirect", "/my%20dir", 301, "", "/my%20dir/"},
+		{"Malformed", "/%zz", 400, "", ""},
+		{"Truncated", "/my%2", 400, "", ""},
+		{"Backslash", "/%5C..%5Csecret.txt", 400, "", ""},
+		{"NUL", "/my%20file.txt%00.html", 400, "", ""},
+		{"Traversal", "/..%2F..%2Fetc%2Fpasswd", 404, "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: root,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if v := res.Header["Location"]; v != tt.locationWant {
+				t.Fatalf("header %q value got: %q, want %q", "Location", v, tt.locationWant)
+			}
+			if tt.filePathWant == "" {
+				return
+			}
+			if want := filepath.Join(root, tt.filePathWant); res.FilePath != want {
+				t.Fatalf("file path got: %q, want: %q", res.FilePath, want)
+			}
+		})
+	}
+}
+
+func TestHandleTryFiles(t *testing.T) {
+	spa := []string{"$uri", "/index.html"}
+	var tests = []struct {
+		name         string
+		tryFiles     []string
+		url          string
+		statusWant   int
+		filePathWant string // relative to doc root
+	}{
+		{"SPAFile", spa, "/subdir/index.html", 200, "subdir/index.html"},
+		{"SPADirectory", spa, "/subdir/", 200, "subdir/index.html"},
+		{"SPARoute", spa, "/app/users/42", 200, "index.html"},
+		{"SPAAsset", spa, "/fake.png", 200, "fake.png"},
+		{"Directory", []string{"$uri", "$uri/", "/index.html"}, "/subdir", 200, "subdir/index.html"},
+		{"Fixed", []string{"/empty.html"}, "/index.html", 200, "empty.html"},
+		{"Traversal", []string{"$uri", "/index.html"}, "/../server.go", 404, ""},
+		{"NoneFound", []string{"$uri", "/notexist.html"}, "/app", 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:     ":0",
+				DocRoot:  "testdata",
+				TryFiles: tt.tryFiles,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if tt.filePathWant == "" {
+				return
+			}
+			filePath, err := normalizeTestdataPath(res.FilePath)
+			if err != nil {
+				t.Fatalf("invalid file path: %q", res.FilePath)
+			}
+			if filePath != tt.filePathWant {
+				t.Fatalf("file path (relative to testdata/) got: %q, want: %q", filePath, tt.filePathWant)
+			}
+		})
+	}
+}
+
+func TestHandleImmutable(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"app.3f2a1b9c.js", "app.js", "index.html"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var tests = []struct {
+		name             string
+		url              string
+		ifModifiedSince  string
+		statusWant       int
+		cacheControlWant string
+	}{
+		{"Fingerprinted", "/app.3f2a1b9c.js", "", 200, "public, max-age=31536000, immutable"},
+		{"NotModified", "/app.3f2a1b9c.js", FormatTime(time.Now().Add(time.Hour)), 304, "public, max-age=31536000, immutable"},
+		{"Plain", "/app.js", "", 200, ""},
+		{"Index", "/", "", 200, ""},
+		{"NotFound", "/app.00000000.js", "", 404, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:             ":0",
+				DocRoot:          root,
+				ImmutablePattern: regexp.MustCompile(`\.[0-9a-f]{8,}\.(js|css)$`),
+			}
+			header := map[string]string{}
+			if tt.ifModifiedSince != "" {
+				header["If-Modified-Since"] = tt.ifModifiedSince
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: header,
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if v := res.Header["Cache-Control"]; v != tt.cacheControlWant {
+				t.Fatalf("header %q value got: %q, want %q", "Cache-Control", v, tt.cacheControlWant)
+			}
+		})
+	}
+}
+
+func TestHandlePrecompressed(t *testing.T) {
+	var tests = []struct {
+		name           string
+		url            string
+		acceptEncoding string
+		filePathWant   string // relative to doc root
+		encodingWant   string
+	}{
+		{"OnlyGzip", "/precompressed/gz.html", "gzip, br", "precompressed/gz.html.gz", "gzip"},
+		{"BothPreferBrotli", "/precompressed/both.html", "gzip, br", "precompressed/both.html.br", "br"},
+		{"BothClientPrefersGzip", "/precompressed/both.html", "gzip, br;q=0.5", "precompressed/both.html.gz", "gzip"},
+		{"BothOnlyGzipAccepted", "/precompressed/both.html", "gzip", "precompressed/both.html.gz", "gzip"},
+		{"BothWildcard", "/precompressed/both.html", "*", "precompressed/both.html.br", "br"},
+		{"BothRefused", "/precompressed/both.html", "br;q=0, gzip;q=0", "precompressed/both.html", ""},
+		{"NoAcceptEncoding", "/precompressed/both.html", "", "precompressed/both.html", ""},
+		{"Neither", "/precompressed/plain.html", "gzip, br", "precompressed/plain.html", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:               ":0",
+				DocRoot:            "testdata",
+				ServePrecompressed: true,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			if tt.acceptEncoding != "" {
+				req.Header["Accept-Encoding"] = tt.acceptEncoding
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			filePath, err := normalizeTestdataPath(res.FilePath)
+			if err != nil {
+				t.Fatalf("invalid file path: %q", res.FilePath)
+			}
+			if filePath != tt.filePathWant {
+				t.Fatalf("file path (relative to testdata/) got: %q, want: %q", filePath, tt.filePathWant)
+			}
+			fi, err := os.Stat(filepath.Join("testdata", tt.filePathWant))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for h, vWant := range map[string]string{
+				"Content-Encoding": tt.encodingWant,
+				"Content-Type":     contentTypeHTML,
+				"Content-Length":   strconv.FormatInt(fi.Size(), 10),
+				"Vary":             "Accept-Encoding",
+			} {
+				if v := res.Header[h]; v != vWant {
+					t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlePrecompressedRange(t *testing.T) {
+	s := &Server{
+		Addr:               ":0",
+		DocRoot:            "testdata",
+		ServePrecompressed: true,
+	}
+	req := &Request{
+		Method: "GET",
+		URL:    "/precompressed/gz.html",
+		Proto:  "HTTP/1.1",
+		Header: map[string]string{"Accept-Encoding": "gzip", "Range": "bytes=0-9"},
+		Host:   "test",
+	}
+	res := s.HandleGoodRequest(req)
+	if res.StatusCode != 206 {
+		t.Fatalf("status code got: %v, want: %v", res.StatusCode, 206)
+	}
+
+	// The range is of the compressed sibling, not of the file requested
+	compressed, err := os.ReadFile(filepath.Join("testdata", "precompressed", "gz.html.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, vWant := range map[string]string{
+		"Content-Encoding": "gzip",
+		"Content-Range":    "bytes 0-9/" + strconv.Itoa(len(compressed)),
+		"Content-Length":   "10",
+	} {
+		if v := res.Header[h]; v != vWant {
+			t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+		}
+	}
+	var buffer bytes.Buffer
+	if err := res.WriteBody(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	if got := buffer.Bytes(); !bytes.Equal(got, compressed[:10]) {
+		t.Fatalf("body got: %q, want: %q", got, compressed[:10])
+	}
+}
+
+func TestHandleDefaultFavicon(t *testing.T) {
+	favicon := []byte("default icon")
+	var tests = []struct {
+		name            string
+		defaultFavicon  []byte
+		realFavicon     []byte
+		tryFiles        []string
+		statusWant      int
+		bodyWant        []byte
+		contentTypeWant string
+		cacheWant       string
+	}{
+		{"Fallback", favicon, nil, nil, 200, favicon, "image/x-icon", faviconCacheControl},
+		// The type of real files depends on the system MIME types
+		{"RealFavicon", favicon, []byte("real icon"), nil, 200, []byte("real icon"), contentType(".ico"), ""},
+		{"NoFallback", nil, nil, nil, 404, notFoundBody, "", ""},
+		// TryFiles are resolved first, and the fallback is served if none exists
+		{"TryFilesFallback", favicon, nil, []string{"$uri", "/missing.ico"}, 200, favicon, "image/x-icon", faviconCacheControl},
+		{"TryFilesRealFavicon", favicon, []byte("real icon"), []string{"$uri"}, 200, []byte("real icon"), contentType(".ico"), ""},
+		{"TryFilesCatchAll", favicon, nil, []string{"$uri", "/index.html"}, 200, []byte("<h1>app</h1>\n"), contentTypeHTML, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			if tt.realFavicon != nil {
+				if err := os.WriteFile(filepath.Join(root, "favicon.ico"), tt.realFavicon, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := os.WriteFile(filepath.Join(root, "index.html"), []byte("<h1>app</h1>\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{
+				Addr:           ":0",
+				DocRoot:        root,
+				DefaultFavicon: tt.defaultFavicon,
+				TryFiles:       tt.tryFiles,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/favicon.ico",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != tt.statusWant {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+			}
+			if tt.statusWant == 200 {
+				for h, vWant := range map[string]string{
+					"Content-Type":   tt.contentTypeWant,
+					"Content-Length": strconv.Itoa(len(tt.bodyWant)),
+					"Cache-Control":  tt.cacheWant,
+				} {
+					if v := res.Header[h]; v != vWant {
+						t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+					}
+				}
+			}
+			var buffer bytes.Buffer
+			if err := res.WriteBody(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buffer.Bytes(), tt.bodyWant) {
+				t.Fatalf("body got: %q, want: %q", buffer.Bytes(), tt.bodyWant)
+			}
+		})
+	}
+}
+
+func TestHandleDirectoryListing(t *testing.T) {
+	root := t.TempDir()
+	for _, dir := range []string{"dir/sub", "indexed"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"dir/a.txt", "dir/b c.html", "indexed/index.html"} {
+		if err := os.WriteFile(filepath.Join(root, file), []byte("file\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name       string
+		listing    bool
+		url        string
+		statusWant int
+		linksWant  []string
+	}{
+		{"Directory", true, "/dir/", 200, []string{"../", "a.txt", "b%20c.html", "sub/"}},
+		{"Root", true, "/", 200, []string{"dir/", "indexed/"}},
+		{"Empty", true, "/dir/sub/", 200, []string{"../"}},
+		{"Index", true, "/indexed/", 200, nil},
+		{"Missing", true, "/missing/", 404, nil},
+		{"Traversal", true, "/../", 404, nil},
+		{"Disabled", false, "/dir/", 404, nil},
+	}
+
+	for _, snapshot := range []bool{false, true} {
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%v/Snapshot=%v", tt.name, snapshot), func(t *testing.T) {
+				s := &Server{
+					Addr:             ":0",
+					DocRoot:          root,
+					DirectoryListing: tt.listing,
+				}
+				if snapshot {
+					if err := s.takeSnapshot(); err != nil {
+						t.Fatal(err)
+					}
+				}
+				req := &Request{
+					Method: "GET",
+					URL:    tt.url,
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{},
+					Host:   "test",
+				}
+				res := s.HandleGoodRequest(req)
+				if res.StatusCode != tt.statusWant {
+					t.Fatalf("status code got: %v, want: %v", res.StatusCode, tt.statusWant)
+				}
+				if tt.linksWant == nil {
+					return
+				}
+
+				body := string(res.Body)
+				if v := res.Header["Content-Type"]; v != contentTypeHTML {
+					t.Fatalf("header %q value got: %q, want %q", "Content-Type", v, contentTypeHTML)
+				}
+				if v := res.Header["Content-Length"]; v != strconv.Itoa(len(body)) {
+					t.Fatalf("header %q value got: %q, want %q", "Content-Length", v, strconv.Itoa(len(body)))
+				}
+				var links []string
+				for _, m := range regexp.MustCompile(`href="([^"]*)"`).FindAllStringSubmatch(body, -1) {
+					links = append(links, m[1])
+				}
+				if !reflect.DeepEqual(links, tt.linksWant) {
+					t.Fatalf("links got: %q, want: %q", links, tt.linksWant)
+				}
+			})
+		}
+	}
+}
+
+func TestHandleDirectoryListingHead(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "a.txt"), []byte("file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:             ":0",
+		DocRoot:          root,
+		DirectoryListing: true,
+	}
+	write := func(method string) (*Response, string) {
+		req := &Request{
+			Method: method,
+			URL:    "/dir/",
+			Proto:  "HTTP/1.1",
+			Header: map[string]string{},
+			Host:   "test",
+		}
+		res := s.HandleGoodRequest(req)
+		if res.StatusCode != 200 {
+			t.Fatalf("%v status code got: %v, want: %v", method, res.StatusCode, 200)
+		}
+		var buffer bytes.Buffer
+		if err := res.Write(&buffer); err != nil {
+			t.Fatal(err)
+		}
+		return res, buffer.String()
+	}
+
+	get, getOut := write("GET")
+	head, headOut := write("HEAD")
+	if v := head.Header["Content-Type"]; v != contentTypeHTML {
+		t.Fatalf("header %q value got: %q, want %q", "Content-Type", v, contentTypeHTML)
+	}
+	// The Content-Length of the HEAD response is that of the GET body
+	body := getOut[strings.Index(getOut, "\r\n\r\n")+4:]
+	if v := head.Header["Content-Length"]; v != strconv.Itoa(len(body)) || v != get.Header["Content-Length"] {
+		t.Fatalf("header %q value got: %q, want %q", "Content-Length", v, strconv.Itoa(len(body)))
+	}
+	if !strings.HasSuffix(headOut, "\r\n\r\n") || strings.Count(headOut, "\r\n\r\n") != 1 {
+		t.Fatalf("HEAD response got: %q, want no body", headOut)
+	}
+	if head.bodyBytes != 0 {
+		t.Fatalf("body bytes got: %v, want: %v", head.bodyBytes, 0)
+	}
+}
+
+func TestHandleByteOrderMark(t *testing.T) {
+	var tests = []struct {
+		name            string
+		file            string
+		content         string
+		contentTypeWant string
+	}{
+		{"UTF8", "utf8.txt", "\xef\xbb\xbfhello", "text/plain; charset=utf-8"},
+		{"UTF16LE", "utf16le.txt", "\xff\xfeh\x00i\x00", "text/plain; charset=utf-16le"},
+		{"UTF16BE", "utf16be.html", "\xfe\xff\x00h\x00i", "text/html; charset=utf-16be"},
+		{"NoBOM", "plain.txt", "hello", "text/plain; charset=utf-8"},
+		{"Short", "short.txt", "\xff", "text/plain; charset=utf-8"},
+		{"Empty", "empty.txt", "", "text/plain; charset=utf-8"},
+		// Only text files are sniffed
+		{"Binary", "image.png", "\xff\xfe\x00\x00", contentTypePNG},
+	}
+
+	root := t.TempDir()
+	for _, tt := range tests {
+		if err := os.WriteFile(filepath.Join(root, tt.file), []byte(tt.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: root,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    "/" + tt.file,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			if v := res.Header["Content-Type"]; v != tt.contentTypeWant {
+				t.Fatalf("header %q value got: %q, want %q", "Content-Type", v, tt.contentTypeWant)
+			}
+		})
+	}
+}
+
+func TestHandleByteOrderMarkReads(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "utf8.txt")
+	if err := os.WriteFile(file, []byte("\xef\xbb\xbfhello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name      string
+		method    string
+		ims       string
+		times     int
+		readsWant int
+	}{
+		// A 304 has no Content-Type to pick
+		{"NotModified", "GET", "Fri, 01 Jan 2100 00:00:00 GMT", 3, 0},
+		// The charset is cached while the file isn't modified
+		{"Repeated", "GET", "", 3, 1},
+		{"Head", "HEAD", "", 3, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reads := 0
+			s := &Server{
+				Addr:    ":0",
+				DocRoot: root,
+				openFile: func(name string) (io.ReadCloser, error) {
+					if name == file {
+						reads++
+					}
+					return os.Open(name)
+				},
+			}
+			for i := 0; i < tt.times; i++ {
+				req := &Request{
+					Method: tt.method,
+					URL:    "/utf8.txt",
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{},
+					Host:   "test",
+				}
+				if tt.ims != "" {
+					req.Header["If-Modified-Since"] = tt.ims
+				}
+				res := s.HandleGoodRequest(req)
+				if res.StatusCode == 200 && res.Header["Content-Type"] != "text/plain; charset=utf-8" {
+					t.Fatalf("header %q value got: %q, want %q", "Content-Type", res.Header["Content-Type"], "text/plain; charset=utf-8")
+				}
+			}
+			if reads != tt.readsWant {
+				t.Fatalf("reads got: %v, want: %v", reads, tt.readsWant)
+			}
+		})
+	}
+}
+
+func TestHandleGzip(t *testing.T) {
+	var tests = []struct {
+		name           string
+		enableGzip     bool
+		url            string
+		acceptEncoding string
+		encodingWant   string
+		varyWant       string
+		maxGzipSize    int64
+	}{
+		{"HTML", true, "/index.html", "gzip, deflate", "gzip", "Accept-Encoding", 0},
+		{"Text", true, "/utf8.txt", "gzip", "gzip", "Accept-Encoding", 0},
+		{"Image", true, "/fake.png", "gzip", "", "", 0},
+		{"NotAccepted", true, "/index.html", "br", "", "Accept-Encoding", 0},
+		{"NoAcceptEncoding", true, "/index.html", "", "", "Accept-Encoding", 0},
+		{"Disabled", false, "/index.html", "gzip", "", "", 0},
+		{"AtMaxSize", true, "/index.html", "gzip", "gzip", "Accept-Encoding", 12},
+		{"TooLarge", true, "/index.html", "gzip", "", "", 11},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{
+				Addr:           ":0",
+				DocRoot:        "testdata",
+				EnableGzip:     tt.enableGzip,
+				MaxGzipSize:    tt.maxGzipSize,
+				EmitContentMD5: true,
+			}
+			req := &Request{
+				Method: "GET",
+				URL:    tt.url,
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{},
+				Host:   "test",
+			}
+			if tt.acceptEncoding != "" {
+				req.Header["Accept-Encoding"] = tt.acceptEncoding
+			}
+			res := s.HandleGoodRequest(req)
+			if res.StatusCode != 200 {
+				t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+			}
+			for h, vWant := range map[string]string{
+				"Content-Encoding": tt.encodingWant,
+				"Vary":             tt.varyWant,
+			} {
+				if v := res.Header[h]; v != vWant {
+					t.Fatalf("header %q value got: %q, want %q", h, v, vWant)
+				}
+			}
+
+			var buffer bytes.Buffer
+			if err := res.WriteBody(&buffer); err != nil {
+				t.Fatal(err)
+			}
+			body := buffer.Bytes()
+			if v := res.Header["Content-Length"]; v != strconv.Itoa(len(body)) {
+				t.Fatalf("header %q value got: %q, want %q", "Content-Length", v, strconv.Itoa(len(body)))
+			}
+			sum := md5.Sum(body)
+			if v, vWant := res.Header["Content-MD5"], base64.StdEncoding.EncodeToString(sum[:]); v != vWant {
+				t.Fatalf("header %q value got: %q, want %q", "Content-MD5", v, vWant)
+			}
+			if tt.encodingWant == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(filepath.Join("testdata", tt.url))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(body, want) {
+				t.Fatalf("body got: %q, want: %q", body, want)
+			}
+		})
+	}
+}
+
+// blockingWriter records what is written to it, once release is closed.
+// started is closed on the first write.
+type blockingWriter struct {
+	bytes.Buffer
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() { close(w.started) })
+	<-w.release
+	return w.Buffer.Write(p)
+}
+
+func TestWriteResponseMaxInFlightBodyBytes(t *testing.T) {
+	root := t.TempDir()
+	const size = 64 << 10
+	if err := os.WriteFile(filepath.Join(root, "large.html"), bytes.Repeat([]byte("a"), size), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:                 ":0",
+		DocRoot:              root,
+		EnableGzip:           true,
+		MaxInFlightBodyBytes: size,
+	}
+
+	// Responses being written concurrently, each holding its body
+	const n = 4
+	release := make(chan struct{})
+	writers := make([]*blockingWriter, n)
+	var wg sync.WaitGroup
+	for i := range writers {
+		w := &blockingWriter{started: make(chan struct{}), release: release}
+		writers[i] = w
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := &Request{
+				Method: "GET",
+				URL:    "/large.html",
+				Proto:  "HTTP/1.1",
+				Header: map[string]string{"Accept-Encoding": "gzip"},
+				Host:   "test",
+			}
+			if _, _, _, err := s.writeResponse(w, req, time.Now()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	for _, w := range writers {
+		<-w.started
+	}
+	s.inFlightMu.Lock()
+	inFlight := s.inFlightBodyBytes
+	s.inFlightMu.Unlock()
+	if inFlight <= 0 || inFlight > s.MaxInFlightBodyBytes {
+		t.Fatalf("in-flight body bytes got: %v, want: in (0, %v]", inFlight, s.MaxInFlightBodyBytes)
+	}
+	close(release)
+	wg.Wait()
+
+	// The large file is compressed once, as that leaves no room for
+	// another one, and the other responses stream it uncompressed
+	gzipped := 0
+	for _, w := range writers {
+		out := w.String()
+		if strings.Contains(out, "Content-Encoding: gzip\r\n") {
+			gzipped++
+		} else if !strings.Contains(out, "Content-Length: "+strconv.Itoa(size)+"\r\n") {
+			t.Fatalf("response %q is neither compressed nor the whole file", out)
+		}
+	}
+	if gzipped != 1 {
+		t.Fatalf("compressed responses got: %v, want: %v", gzipped, 1)
+	}
+	if s.inFlightBodyBytes != 0 {
+		t.Fatalf("in-flight body bytes got: %v, want: %v", s.inFlightBodyBytes, 0)
+	}
+}
+
+func TestHandleGzipHead(t *testing.T) {
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		t.Run("AcceptEncoding="+acceptEncoding, func(t *testing.T) {
+			s := &Server{
+				Addr:           ":0",
+				DocRoot:        "testdata",
+				EnableGzip:     true,
+				EmitContentMD5: true,
+			}
+			header := func(method string) map[string]string {
+				req := &Request{
+					Method: method,
+					URL:    "/index.html",
+					Proto:  "HTTP/1.1",
+					Header: map[string]string{"Accept-Encoding": acceptEncoding},
+					Host:   "test",
+				}
+				res := s.HandleGoodRequest(req)
+				if res.StatusCode != 200 {
+					t.Fatalf("status code got: %v, want: %v", res.StatusCode, 200)
+				}
+				delete(res.Header, "Date")
+				return res.Header
+			}
+			// A HEAD response has the headers of the GET, Content-Length included
+			get, head := header("GET"), header("HEAD")
+			if !reflect.DeepEqual(head, get) {
+				t.Fatalf("HEAD headers got: %v, want: %v", head, get)
+			}
+		})
+	}
+}
+
+func TestHandleConnectionClientGone(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "large.bin"), bytes.Repeat([]byte("x"), 10<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Addr:    ":0",
+		DocRoot: root,
+	}
+	client, done := serveOnPipe(s)
+	defer client.Close()
+
+	go func() {
+		_, _ = io.WriteString(client, "GET /large.bin HTTP/1.1\r\nHost: test\r\n\r\n")
+	}()
+	// Receive only the beginning of the response, then go away
+	if _, err := io.ReadFull(client, make([]byte, 4096)); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("HandleConnection did not return after the client closed the connection")
+	}
+}
+
+func TestHandleConnectionReadTimeout(t *testing.T) {
+	s := &Server{
+		Addr:        ":0",
+		DocRoot:     "testdata",
+		ReadTimeout: 100 * time.Millisecond,
+	}
+	client, done := serveOnPipe(s)
+	defer client.Close()
+
+	start := time.Now()
+	if _, err := io.WriteString(client, "GET /index.html HTTP/1.1\r\nHost: te"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	want := []string{"HTTP/1.1 408 Request Timeout"}
+	if got := statusLines(string(out)); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got: %q, want: %q", got, want)
+	}
+	if elapsed < s.ReadTimeout || elapsed > time.Second {
+		t.Fatalf("connection closed after %v, want about %v", elapsed, s.ReadTimeout)
+	}
+	<-done
+}
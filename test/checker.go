@@ -27,8 +27,16 @@ var statusLineWant = map[int]string{
 	200: "HTTP/1.1 200 OK",
 	400: "HTTP/1.1 400 Bad Request",
 	404: "HTTP/1.1 404 Not Found",
+	405: "HTTP/1.1 405 Method Not Allowed",
+	408: "HTTP/1.1 408 Request Timeout",
 }
 
+// The default bodies of the 400 and 404 responses
+const (
+	badRequestBody = "<html><body><h1>400 Bad Request</h1></body></html>\n"
+	notFoundBody   = "<html><body><h1>404 Not Found</h1></body></html>\n"
+)
+
 func (rc *ResponseChecker) Check(br *bufio.Reader) error {
 	// Check status line
 	line, err := tritonhttp.ReadLine(br)
@@ -60,12 +68,27 @@ func (rc *ResponseChecker) Check(br *bufio.Reader) error {
 			specs = append(connCloseHeader, specs...)
 		}
 	case 400:
+		specs = []HeaderSpec{
+			{"Connection", "close"},
+			{"Content-Length", fmt.Sprint(len(badRequestBody))},
+			{"Content-Type", "text/html; charset=utf-8"},
+			{"Date", ""},
+		}
+	case 405:
+		specs = []HeaderSpec{
+			{"Allow", "GET, HEAD, OPTIONS"},
+			{"Connection", "close"},
+			{"Date", ""},
+		}
+	case 408:
 		specs = []HeaderSpec{
 			{"Connection", "close"},
 			{"Date", ""},
 		}
 	case 404:
 		specs = []HeaderSpec{
+			{"Content-Length", fmt.Sprint(len(notFoundBody))},
+			{"Content-Type", "text/html; charset=utf-8"},
 			{"Date", ""},
 		}
 		if rc.Close {
@@ -79,10 +102,19 @@ func (rc *ResponseChecker) Check(br *bufio.Reader) error {
 	}
 
 	// Check body
-	if rc.StatusCode == 200 {
+	switch rc.StatusCode {
+	case 200:
 		if err := checkBody(br, rc.FilePath); err != nil {
 			return err
 		}
+	case 400:
+		if err := checkBodyBytes(br, badRequestBody); err != nil {
+			return err
+		}
+	case 404:
+		if err := checkBodyBytes(br, notFoundBody); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -127,6 +159,18 @@ func checkHeaders(br *bufio.Reader, specs []HeaderSpec) error {
 	return nil
 }
 
+// checkBodyBytes checks that the next bytes of br are the body want.
+func checkBodyBytes(br *bufio.Reader, want string) error {
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(br, got); err != nil {
+		return err
+	}
+	if string(got) != want {
+		return fmt.Errorf("got body: %q, want: %q", got, want)
+	}
+	return nil
+}
+
 func checkBody(br *bufio.Reader, path string) error {
 	fi, err := os.Stat(path)
 	if err != nil {
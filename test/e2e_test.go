@@ -82,7 +82,7 @@ func TestSingleRequest(t *testing.T) {
 		{
 			"BadRequestTimeout",
 			&ResponseChecker{
-				StatusCode: 400,
+				StatusCode: 408,
 			},
 		},
 		{
@@ -171,7 +171,8 @@ func TestPipelineRequest(t *testing.T) {
 					Close:       false,
 				},
 				{
-					StatusCode: 400,
+					// GETT is a well-formed but unsupported method
+					StatusCode: 405,
 				},
 			},
 		},